@@ -6,6 +6,7 @@ require (
 	github.com/adrg/xdg v0.4.0
 	github.com/c-robinson/iplib v1.0.3
 	github.com/go-resty/resty/v2 v2.7.0
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/whiteboxvpn/cli/types v0.0.0-20230520164024-d9a8a37a8439
 	golang.org/x/crypto v0.0.0-20221012134737-56aed061732a
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20220916014741-473347a5e6e3
@@ -15,3 +16,5 @@ require (
 	golang.org/x/net v0.0.0-20220418201149-a630d4f3e7a2 // indirect
 	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
 )
+
+replace github.com/whiteboxvpn/cli/types => ../types
@@ -29,6 +29,11 @@ const OAUTH_DEVICE_CODE_URL = "https://whiteboxvpn.us.auth0.com/oauth/device/cod
 const OAUTH_AUDIENCE_URL = "https://console.whiteboxvpn.com/api/"
 const OAUTH_TOKEN_URL = "https://whiteboxvpn.us.auth0.com/oauth/token"
 const OAUTH_CLIENT_ID = "tXcyY7reNAvr1zEBt6a7TW2aa4vnOS8N"
+const WBD_SOCKET_PATH = "/run/whitebox/wbd.sock"
+
+// LAN_RANGES are the private (RFC 1918 and unique local) and link-local
+// ranges left out of the tunnel by --allow-lan.
+var LAN_RANGES = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "fc00::/7", "fe80::/10"}
 
 func main() {
 
@@ -37,7 +42,21 @@ func main() {
 	serversListCommand := flag.NewFlagSet("list", flag.ExitOnError)
 	connectCommand := flag.NewFlagSet("connect", flag.ExitOnError)
 	serverName := connectCommand.String("server-name", "", "The name of the server")
+	connectFlags := addConnectFlags(connectCommand)
+	replace := connectCommand.String("replace", "", "Replace the named tunnel in place, without a moment where traffic leaves outside the VPN")
+	netns := connectCommand.Bool("netns", false, "Confine the VPN to a network namespace, for commands started with \"wb exec --\"")
+	switchCommand := flag.NewFlagSet("switch", flag.ExitOnError)
+	switchFlags := addConnectFlags(switchCommand)
+	switchTunnel := switchCommand.String("tunnel", "", "The tunnel to move, needed when more than one is up")
 	disconnectCommand := flag.NewFlagSet("disconnect", flag.ExitOnError)
+	statusCommand := flag.NewFlagSet("status", flag.ExitOnError)
+	statusJson := statusCommand.Bool("json", false, "Print the status as JSON")
+	statusWatch := statusCommand.Bool("watch", false, "Keep printing the tunnels' events as they happen")
+	notifyCommand := flag.NewFlagSet("notify", flag.ExitOnError)
+	execCommand := flag.NewFlagSet("exec", flag.ExitOnError)
+	execTunnel := execCommand.Bool("tunnel", false, "Send the command's traffic through the VPN")
+	execBypass := execCommand.Bool("bypass", false, "Keep the command's traffic out of the VPN")
+	versionCommand := flag.NewFlagSet("version", flag.ExitOnError)
 
 	if len(os.Args) == 1 {
 		printHelp()
@@ -51,8 +70,18 @@ func main() {
 		serversCommand.Parse(os.Args[2:])
 	case "connect":
 		connectCommand.Parse(os.Args[2:])
+	case "switch":
+		switchCommand.Parse(os.Args[2:])
 	case "disconnect":
 		disconnectCommand.Parse(os.Args[2:])
+	case "status":
+		statusCommand.Parse(os.Args[2:])
+	case "exec":
+		execCommand.Parse(os.Args[2:])
+	case "notify":
+		notifyCommand.Parse(os.Args[2:])
+	case "version":
+		versionCommand.Parse(os.Args[2:])
 	default:
 		printHelp()
 	}
@@ -85,12 +114,50 @@ func main() {
 		if len(os.Args) == 2 {
 			fmt.Println("usage: wb connect <servername>")
 		} else {
-			connect(*serverName)
+			options := connectFlags.options()
+			options.Namespace = *netns
+			options.Replace = *replace
+			connect(*serverName, options)
+		}
+	}
+
+	if switchCommand.Parsed() {
+		if switchCommand.NArg() != 1 {
+			fmt.Println("usage: wb switch [--tunnel <name>] <servername>")
+		} else {
+			switchServer(switchCommand.Arg(0), *switchTunnel, switchFlags.options())
 		}
 	}
 
 	if disconnectCommand.Parsed() {
-		disconnect()
+		disconnect(disconnectCommand.Arg(0))
+	}
+
+	if statusCommand.Parsed() {
+		status(statusCommand.Arg(0), *statusJson, *statusWatch)
+	}
+
+	if notifyCommand.Parsed() {
+		notifyEvents()
+	}
+
+	if execCommand.Parsed() {
+		if (*execTunnel && *execBypass) || execCommand.NArg() == 0 {
+			fmt.Println("usage: wb exec [--tunnel|--bypass] -- <command> [<args>]")
+			os.Exit(2)
+		}
+		if !*execTunnel && !*execBypass {
+			os.Exit(execInNamespace(execCommand.Args()))
+		}
+		policy := "tunnel"
+		if *execBypass {
+			policy = "bypass"
+		}
+		execApp(policy, execCommand.Args())
+	}
+
+	if versionCommand.Parsed() {
+		printVersion()
 	}
 
 }
@@ -101,5 +168,62 @@ func printHelp() {
 	fmt.Println(" login       Log in to your account")
 	fmt.Println(" servers     List your VPN Servers")
 	fmt.Println(" connect     Connect to a VPN server")
-	fmt.Println(" disconnect  Disconnect to a VPN server")
+	fmt.Println(" switch      Move to another VPN server without dropping the connection")
+	fmt.Println(" disconnect  Disconnect from a VPN server, or from all of them")
+	fmt.Println(" status      Show the status of the VPN connections")
+	fmt.Println(" exec        Run a command with or without the VPN")
+	fmt.Println(" notify      Show desktop notifications of VPN events, in your session")
+	fmt.Println(" version     Show the versions of wb and of the VPN daemon")
+}
+
+// connectFlags holds the flags of the options that the connect and switch
+// commands share.
+type connectFlags struct {
+	killSwitch    *bool
+	dnsServers    *string
+	searchDomains *string
+	includeRanges *string
+	excludeRanges *string
+	tunnelDomains *string
+	allowLan      *bool
+	appsOnly      *bool
+	keepalive     *int
+}
+
+func addConnectFlags(command *flag.FlagSet) *connectFlags {
+	return &connectFlags{
+		killSwitch:    command.Bool("kill-switch", false, "Block all traffic outside the VPN until you disconnect"),
+		dnsServers:    command.String("dns", "", "Comma separated DNS servers to use while connected, instead of the system's. Needed with --domains, to resolve them"),
+		searchDomains: command.String("search", "", "Comma separated DNS search domains to use while connected"),
+		includeRanges: command.String("include", "", "Comma separated ranges to send through the VPN instead of all traffic"),
+		excludeRanges: command.String("exclude", "", "Comma separated ranges to keep out of the VPN"),
+		tunnelDomains: command.String("domains", "", "Comma separated domains, such as *.corp.example, to send through the VPN instead of all traffic"),
+		allowLan:      command.Bool("allow-lan", false, "Keep private and link-local ranges out of the VPN"),
+		appsOnly:      command.Bool("apps-only", false, "Only send applications started with \"wb exec --tunnel\" through the VPN"),
+		keepalive:     command.Int("keepalive", 0, "Seconds between keepalives, to keep NAT mappings open while idle, 0 for none"),
+	}
+}
+
+func (f *connectFlags) options() connectOptions {
+	options := connectOptions{
+		KillSwitch:    *f.killSwitch,
+		DNSServers:    splitList(*f.dnsServers),
+		SearchDomains: splitList(*f.searchDomains),
+		IncludeRanges: splitList(*f.includeRanges),
+		ExcludeRanges: splitList(*f.excludeRanges),
+		TunnelDomains: splitList(*f.tunnelDomains),
+		AppsOnly:      *f.appsOnly,
+		Keepalive:     *f.keepalive,
+	}
+	if *f.allowLan {
+		options.ExcludeRanges = append(options.ExcludeRanges, LAN_RANGES...)
+	}
+
+	// Tunneled domains are resolved by the servers given, the system's
+	// would resolve them outside the tunnel
+	if len(options.TunnelDomains) > 0 && len(options.DNSServers) == 0 {
+		fmt.Println("--domains needs --dns with the DNS servers that resolve the domains")
+		os.Exit(2)
+	}
+	return options
 }
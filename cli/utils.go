@@ -20,15 +20,20 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/rpc"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
 	"github.com/adrg/xdg"
+	"github.com/whiteboxvpn/cli/types"
 )
 
 func getToken() string {
@@ -134,6 +139,92 @@ func promptForPassword(prompt string) string {
 	return strings.TrimSpace(text)
 }
 
+// dialDaemon connects to the white box daemon and checks that it speaks
+// the same version of the RPC API.
+func dialDaemon() (*rpc.Client, error) {
+	rpcClient, err := connectDaemon()
+	if err != nil {
+		return nil, err
+	}
+	err = checkVersion(rpcClient)
+	if err != nil {
+		rpcClient.Close()
+		return nil, err
+	}
+	return rpcClient, nil
+}
+
+// connectDaemon connects to the white box daemon without checking its
+// version.
+func connectDaemon() (*rpc.Client, error) {
+	conn, err := daemonConn()
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// daemonConn opens a connection to the white box daemon. By default the
+// daemon's Unix socket is used. Setting WBD_ADDRESS to "tcp://<host>:<port>"
+// connects to a daemon that was explicitly started with TCP enabled
+// instead, any other value is taken as the path of the socket.
+func daemonConn() (net.Conn, error) {
+	address := os.Getenv("WBD_ADDRESS")
+	if strings.HasPrefix(address, "tcp://") {
+		return net.Dial("tcp", strings.TrimPrefix(address, "tcp://"))
+	}
+	if len(address) <= 0 {
+		address = WBD_SOCKET_PATH
+	}
+	return net.Dial("unix", address)
+}
+
+// daemonError turns an error returned by a daemon RPC call into a message
+// that tells the user what went wrong.
+func daemonError(err error) string {
+	if errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "lost the connection to the white box daemon (wbd), check its log for details"
+	}
+	if isVersionError(err) {
+		return err.Error()
+	}
+
+	rpcErr := types.ParseRPCError(err)
+	switch rpcErr.Code {
+	case types.ErrInvalidKey:
+		return "invalid wireguard key: " + rpcErr.Message
+	case types.ErrInvalidConfig:
+		return "invalid tunnel configuration: " + rpcErr.Message
+	case types.ErrLinkExists:
+		return "a conflicting network interface already exists: " + rpcErr.Message
+	case types.ErrTunnelExists:
+		return "already connected: " + rpcErr.Message
+	case types.ErrLinkNotFound:
+		return "the VPN interface does not exist, are you connected? " + rpcErr.Message
+	case types.ErrNotConnected:
+		return "not connected to a VPN server"
+	case types.ErrRuleConflict:
+		return "conflicting routing rules, is another VPN running? " + rpcErr.Message
+	case types.ErrPermissionDenied:
+		return "the daemon may not change the network configuration, is wbd running as root? " + rpcErr.Message
+	default:
+		return "error from the white box daemon: " + rpcErr.Message
+	}
+}
+
+// splitList splits a comma separated command line value, dropping empty
+// entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func contains(arr []string, str string) bool {
 	for _, a := range arr {
 		if a == str {
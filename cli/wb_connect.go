@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"net/rpc"
 	"os"
 	"strconv"
 	"strings"
@@ -18,13 +17,100 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-type Reply struct {
-	Data string
+// connectOptions holds the command line options of the connect command that
+// are passed on to the daemon.
+type connectOptions struct {
+	KillSwitch    bool
+	DNSServers    []string
+	SearchDomains []string
+	IncludeRanges []string
+	ExcludeRanges []string
+	TunnelDomains []string
+	AppsOnly      bool
+	Namespace     bool
+	Replace       string
+	Keepalive     int
 }
 
-func connect(serverName string) {
+func connect(serverName string, options connectOptions) {
 
-	accessToken := getToken()
+	// Adding a peer on the server is wasted on a connection the daemon
+	// refuses
+	if len(options.Replace) == 0 {
+		checkNotConnected(serverName)
+	}
+
+	configData, peer := provisionPeer(serverName, options, sshSigner())
+	defer peer.close()
+	configData.Replace = options.Replace
+
+	// Use white box daemon to set up wireguard tunnel
+	var reply types.Reply
+	rpcClient, err := dialDaemon()
+	if err != nil {
+		peer.fatal(err)
+	}
+	err = rpcClient.Call("Listener.ConfigureWgInterface", configData, &reply)
+	if err != nil {
+		peer.fatal(daemonError(err))
+	}
+	log.Printf("Connected to %s as tunnel %s", serverName, reply.Data)
+}
+
+// provisionedPeer is a peer this client added on a server, with the SSH
+// connection it was added over.
+type provisionedPeer struct {
+	serverName string
+	publicKey  string
+	sshClient  *ssh.Client
+}
+
+func (p *provisionedPeer) close() {
+	p.sshClient.Close()
+}
+
+// fatal removes the peer, which the daemon did not take into use, from the
+// server and exits with the message.
+func (p *provisionedPeer) fatal(v ...interface{}) {
+	removePeer(p.serverName, p.publicKey, p.sshClient)
+	p.close()
+	log.Fatal(v...)
+}
+
+// sshSigner asks the user for their SSH private key, and its passphrase,
+// for connecting to the servers.
+func sshSigner() ssh.Signer {
+	defaultSshPrivateKey := fmt.Sprintf("/home/%s/.ssh/id_rsa", os.Getenv("USER"))
+	privateKeyPromptText := fmt.Sprintf("Select the path to your SSH private key. (Leave blank for %s):", defaultSshPrivateKey)
+	privateKeyPath := promptForString(privateKeyPromptText, defaultSshPrivateKey)
+	key, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		log.Fatalf("unable to read private key: %v", err)
+	}
+	passwordPromptText := fmt.Sprintf("Enter the passphrase for key '%s': ", privateKeyPath)
+	passphrase := promptForPassword(passwordPromptText)
+	var signer ssh.Signer
+	if len(passphrase) <= 0 {
+		// Create the Signer for this private key.
+		signer, err = ssh.ParsePrivateKey(key)
+		if err != nil {
+			log.Fatalf("unable to parse private key: %v", err)
+		}
+	} else {
+		passphraseByteArray := []byte(passphrase)
+		// Create the Signer for this private key.
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphraseByteArray)
+		if err != nil {
+			log.Fatalf("unable to parse private key: %v", err)
+		}
+	}
+	return signer
+}
+
+// dialServer looks the server up by its name and opens an SSH connection
+// to it with the user's key. It returns the server's ID and IP address with
+// the connection.
+func dialServer(serverName string, accessToken string, signer ssh.Signer) (string, string, *ssh.Client) {
 
 	client := resty.New()
 
@@ -52,14 +138,12 @@ func connect(serverName string) {
 	if len(servers) <= 0 {
 		fmt.Println("no servers found with name", serverName)
 		os.Exit(1)
-		return
 	}
 	serverId := servers[0].Id
 	serverIp := servers[0].Ipv4[0]
 
 	// Get the server's SSH Public key from the white box API
 	var publicKeyData map[string]string
-	var signer ssh.Signer
 	queryString := fmt.Sprintf("serverId=%s", serverId)
 	url = fmt.Sprintf("%s/api/servers/sshPublicKeys", SITE_URL)
 	resp, err = client.R().
@@ -78,31 +162,6 @@ func connect(serverName string) {
 		log.Fatal("unable to parse public ssh key: ", err)
 	}
 
-	// Prompt user for information regarding the user's private key
-	defaultSshPrivateKey := fmt.Sprintf("/home/%s/.ssh/id_rsa", os.Getenv("USER"))
-	privateKeyPromptText := fmt.Sprintf("Select the path to your SSH private key. (Leave blank for %s):", defaultSshPrivateKey)
-	privateKeyPath := promptForString(privateKeyPromptText, defaultSshPrivateKey)
-	key, err := os.ReadFile(privateKeyPath)
-	if err != nil {
-		log.Fatalf("unable to read private key: %v", err)
-	}
-	passwordPromptText := fmt.Sprintf("Enter the passphrase for key '%s': ", privateKeyPath)
-	passphrase := promptForPassword(passwordPromptText)
-	if len(passphrase) <= 0 {
-		// Create the Signer for this private key.
-		signer, err = ssh.ParsePrivateKey(key)
-		if err != nil {
-			log.Fatalf("unable to parse private key: %v", err)
-		}
-	} else {
-		passphraseByteArray := []byte(passphrase)
-		// Create the Signer for this private key.
-		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphraseByteArray)
-		if err != nil {
-			log.Fatalf("unable to parse private key: %v", err)
-		}
-	}
-
 	// Set up the SSH client configuration
 	config := &ssh.ClientConfig{
 		User: "root",
@@ -118,65 +177,60 @@ func connect(serverName string) {
 	if err != nil {
 		log.Fatal("unable to connect: ", err)
 	}
-	defer sshClient.Close()
+	return serverId, serverIp, sshClient
+}
 
-	// Create a new SSH Session
-	session, err := sshClient.NewSession()
-	if err != nil {
-		log.Fatal("unable to create session: ", err)
-	}
-	defer session.Close()
+// provisionPeer adds a new peer for this client on the server and returns
+// the configuration the daemon needs to connect to it, with the peer. The
+// peer's SSH connection stays open for removing the peer again, and is the
+// caller's to close.
+func provisionPeer(serverName string, options connectOptions, signer ssh.Signer) (types.ConfigData, *provisionedPeer) {
+
+	accessToken := getToken()
+	serverId, serverIp, sshClient := dialServer(serverName, accessToken, signer)
 
 	// Run commands to find server-side IP addresses and to find an
 	// availble client-side IP address
 	var availableAddress net.IP
+	var availableAddress6 net.IP
 	var serverInterfaceList []string
 	var serverInterfaceName string
 	var serverWireguardPort int
+	var err error
 	runCommandOnServer("wg show interfaces | xargs -d ' ' -I '{}' echo '{}'", func(line string) {
 		if len(line) > 0 {
 			serverInterfaceList = append(serverInterfaceList, line)
 		}
 	}, sshClient)
 
+	// Run command to get all used client IP addresses
+	var usedIpAddresses []string
+	runCommandOnServer("wg show all allowed-ips | awk '{ for (i = 3; i <= NF; i++) if ($i ~ /\\//) print $i }'", func(line string) {
+		ip, _, err := iplib.ParseCIDR(line)
+		if err != nil {
+			log.Fatal("failed to parse CIDR: ", err)
+		}
+		usedIpAddresses = append(usedIpAddresses, ip.String())
+	}, sshClient)
+
 	for _, serverInterface := range serverInterfaceList {
 
 		serverInterfaceName = serverInterface
-		var usedIpAddresses []string
-		var networkRange iplib.Net
-
-		// Run command to get the network range this interface uses
-		cmd := fmt.Sprintf("ip address show dev %s | awk '/scope global/ { print $2 }'", serverInterface)
-		runCommandOnServer(cmd, func(line string) {
-			ip, ipNetwork, err := iplib.ParseCIDR(line)
-			if err != nil {
-				log.Fatal("failed to parse CIDR: ", err)
-			}
-			usedIpAddresses = append(usedIpAddresses, ip.String())
-			networkRange = ipNetwork
-		}, sshClient)
-
-		// Run command to get all used client IP addresses
-		runCommandOnServer("wg show all allowed-ips | awk '{ print $3 }'", func(line string) {
-			ip, _, err := iplib.ParseCIDR(line)
-			if err != nil {
-				log.Fatal("failed to parse CIDR: ", err)
-			}
-			usedIpAddresses = append(usedIpAddresses, ip.String())
-		}, sshClient)
-
-		// Loop over  to find an available IP address
-		var newAddress = networkRange.FirstAddress()
-		var lastAddress = networkRange.LastAddress()
-		for newAddress.String() != lastAddress.String() {
-			if !contains(usedIpAddresses, newAddress.String()) {
-				availableAddress = newAddress
-				break
-			}
-			newAddress = iplib.NextIP(newAddress)
+
+		// Run commands to get the IPv4 and IPv6 network ranges this
+		// interface uses
+		networkRange := serverNetworkRange(serverInterface, 4, &usedIpAddresses, sshClient)
+		if networkRange == nil {
+			continue
 		}
+		availableAddress = findAvailableAddress(networkRange, usedIpAddresses)
 
 		if availableAddress != nil {
+			networkRange6 := serverNetworkRange(serverInterface, 6, &usedIpAddresses, sshClient)
+			if networkRange6 != nil {
+				availableAddress6 = findAvailableAddress(networkRange6, usedIpAddresses)
+			}
+
 			cmd := fmt.Sprintf("wg show %s listen-port", serverInterface)
 			runCommandOnServer(cmd, func(line string) {
 				serverWireguardPort, err = strconv.Atoi(line)
@@ -187,12 +241,22 @@ func connect(serverName string) {
 			break
 		}
 	}
+	if availableAddress == nil {
+		log.Fatal("no client address is available on the server")
+	}
 	clientIp := fmt.Sprintf("%s/32", availableAddress.String())
+	allowedIps := clientIp
+	clientIp6 := ""
+	if availableAddress6 != nil {
+		clientIp6 = fmt.Sprintf("%s/128", availableAddress6.String())
+		allowedIps = fmt.Sprintf("%s,%s", clientIp, clientIp6)
+	}
 
 	// Get the wireguard public key from the white-box API
 	var wgPublicKeyData map[string]string
-	url = fmt.Sprintf("%s/api/servers/wgPublicKeys", SITE_URL)
-	resp, err = client.R().
+	queryString := fmt.Sprintf("serverId=%s", serverId)
+	url := fmt.Sprintf("%s/api/servers/wgPublicKeys", SITE_URL)
+	resp, err := resty.New().R().
 		SetHeader("Accept", "application/json").
 		SetAuthToken(accessToken).
 		SetQueryString(queryString).
@@ -210,33 +274,92 @@ func connect(serverName string) {
 	clientPublicKey := clientPrivateKey.PublicKey()
 
 	// Run command on vpn server to set up the peer
-	session, err = sshClient.NewSession()
+	session, err := sshClient.NewSession()
 	if err != nil {
 		log.Fatal("unable to create session: ", err)
 	}
 	defer session.Close()
-	setPeerCommandText := fmt.Sprintf("wg set %s listen-port %d peer %s allowed-ips %s", serverInterfaceName, serverWireguardPort, clientPublicKey, clientIp)
+	setPeerCommandText := fmt.Sprintf("wg set %s listen-port %d peer %s allowed-ips %s", serverInterfaceName, serverWireguardPort, clientPublicKey, allowedIps)
 	if err := session.Run(setPeerCommandText); err != nil {
 		log.Fatal("failed to run wg set command: ", err)
 	}
 
-	// Use white box daemon to set up wireguard tunnel
-	var reply Reply
-	rpcClient, err := rpc.Dial("tcp", "localhost:12345")
-	if err != nil {
-		log.Fatal(err)
+	peer := &provisionedPeer{
+		serverName: serverName,
+		publicKey:  clientPublicKey.String(),
+		sshClient:  sshClient,
 	}
-	configData := types.ConfigData{
+	return types.ConfigData{
+		ServerName:          serverName,
 		ServerPublicKeyData: wgPublicKeyData["publicKey"],
 		ClientAddress:       clientIp,
+		ClientAddress6:      clientIp6,
 		ServerAddress:       serverIp,
 		ServerPort:          serverWireguardPort,
 		ClientPrivateKey:    clientPrivateKey.String(),
-	}
-	err = rpcClient.Call("Listener.ConfigureWgInterface", configData, &reply)
+		KillSwitch:          options.KillSwitch,
+		DNSServers:          options.DNSServers,
+		SearchDomains:       options.SearchDomains,
+		IncludeRanges:       options.IncludeRanges,
+		ExcludeRanges:       options.ExcludeRanges,
+		TunnelDomains:       options.TunnelDomains,
+		AppsOnly:            options.AppsOnly,
+		Namespace:           options.Namespace,
+		PersistentKeepalive: options.Keepalive,
+	}, peer
+}
+
+// checkNotConnected exits when there already is a tunnel to the server.
+func checkNotConnected(serverName string) {
+	var tunnelStatuses []types.TunnelStatus
+
+	rpcClient, err := dialDaemon()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer rpcClient.Close()
+
+	err = rpcClient.Call("Listener.Status", types.StatusData{Name: serverName}, &tunnelStatuses)
+	if err != nil {
+		if types.ParseRPCError(err).Code == types.ErrNotConnected {
+			return
+		}
+		log.Fatal(daemonError(err))
+	}
+	for _, tunnelStatus := range tunnelStatuses {
+		log.Fatalf("already connected to %s as tunnel %s, use --replace %s to reconnect", serverName, tunnelStatus.Device, tunnelStatus.Device)
+	}
+}
+
+// serverNetworkRange returns the global IPv4 or IPv6 network range of a
+// wireguard interface on the server, or nil when it has none. The server's
+// own addresses are added to usedIpAddresses.
+func serverNetworkRange(serverInterface string, family int, usedIpAddresses *[]string, sshClient *ssh.Client) iplib.Net {
+	var networkRange iplib.Net
+	cmd := fmt.Sprintf("ip -%d address show dev %s scope global | awk '/inet/ { print $2 }'", family, serverInterface)
+	runCommandOnServer(cmd, func(line string) {
+		ip, ipNetwork, err := iplib.ParseCIDR(line)
+		if err != nil {
+			log.Fatal("failed to parse CIDR: ", err)
+		}
+		*usedIpAddresses = append(*usedIpAddresses, ip.String())
+		networkRange = ipNetwork
+	}, sshClient)
+	return networkRange
+}
+
+// findAvailableAddress returns the first address of the network range that
+// is not used yet, or nil when the range is full.
+func findAvailableAddress(networkRange iplib.Net, usedIpAddresses []string) net.IP {
+	var newAddress = networkRange.FirstAddress()
+	var lastAddress = networkRange.LastAddress()
+	for newAddress.String() != lastAddress.String() {
+		if !contains(usedIpAddresses, newAddress.String()) {
+			return newAddress
+		}
+		newAddress = iplib.NextIP(newAddress)
+	}
+	return nil
 }
 
 // This function takes some bash command to be run on the VPN server. The
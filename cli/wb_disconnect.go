@@ -20,30 +20,21 @@ package main
 
 import (
 	"log"
-	"net/rpc"
-)
 
-type VPNDisconnectData struct {
-	ServerAddress string
-	ServerPort    int
-}
+	"github.com/whiteboxvpn/cli/types"
+)
 
-func disconnect() {
-	var reply Reply
+func disconnect(name string) {
+	var reply types.Reply
 
-	rpcClient, err := rpc.Dial("tcp", "localhost:12345")
+	rpcClient, err := dialDaemon()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	data := VPNDisconnectData{
-		ServerAddress: "45.33.35.178",
-		ServerPort:    51820,
-	}
-
-	err = rpcClient.Call("Listener.VPNDisconnect", data, &reply)
+	err = rpcClient.Call("Listener.VPNDisconnect", types.VPNDisconnectData{Name: name}, &reply)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(daemonError(err))
 	}
 	log.Printf("Disconnected")
 }
@@ -0,0 +1,138 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+// execApp has the daemon put this process under the policy, then replaces
+// it with the command, which keeps the policy along with everything it
+// starts.
+func execApp(policy string, args []string) {
+	var reply types.Reply
+
+	rpcClient, err := dialDaemon()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = rpcClient.Call("Listener.JoinAppPolicy", types.AppPolicyData{Policy: policy}, &reply)
+	if err != nil {
+		log.Fatal(daemonError(err))
+	}
+	rpcClient.Close()
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = syscall.Exec(path, args, os.Environ())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// execInNamespace has the daemon run the command in the namespace of a
+// namespaced tunnel, as this user and on this terminal, and returns the
+// command's exit code. The command runs in a session of its own, so
+// interrupts are passed on to it.
+func execInNamespace(args []string) int {
+	var reply types.NamespaceExecReply
+
+	conn, err := daemonConn()
+	if err != nil {
+		log.Fatal(err)
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		log.Fatal("running commands in the namespace needs the daemon's Unix socket")
+	}
+	streams := &rightsConn{UnixConn: unixConn}
+	rpcClient := rpc.NewClient(streams)
+	defer rpcClient.Close()
+	err = checkVersion(rpcClient)
+	if err != nil {
+		log.Fatal(daemonError(err))
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			var signalReply types.Reply
+			rpcClient.Call("Listener.SignalNamespaceCommand", types.NamespaceSignalData{Signal: int(sig.(syscall.Signal))}, &signalReply)
+		}
+	}()
+
+	// The command gets this process's standard streams, passed along with
+	// the call, so it can use nothing this user could not use already
+	streams.attach(os.Stdin, os.Stdout, os.Stderr)
+	err = rpcClient.Call("Listener.ExecInNamespace", types.NamespaceExecData{Args: args, Env: os.Environ()}, &reply)
+	if err != nil {
+		log.Fatal(daemonError(err))
+	}
+	return reply.ExitCode
+}
+
+// rightsConn is a connection to the daemon's Unix socket that can pass
+// files along with what it writes.
+type rightsConn struct {
+	*net.UnixConn
+	lock   sync.Mutex
+	rights []byte
+}
+
+// attach has the files passed along with the next write.
+func (c *rightsConn) attach(files ...*os.File) {
+	var fds []int
+	for _, f := range files {
+		fds = append(fds, int(f.Fd()))
+	}
+	c.lock.Lock()
+	c.rights = syscall.UnixRights(fds...)
+	c.lock.Unlock()
+}
+
+func (c *rightsConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	rights := c.rights
+	c.rights = nil
+	c.lock.Unlock()
+	if rights == nil {
+		return c.UnixConn.Write(p)
+	}
+
+	n, _, err := c.WriteMsgUnix(p, rights, nil)
+	if err == nil && n < len(p) {
+		var m int
+		m, err = c.UnixConn.Write(p[n:])
+		n += m
+	}
+	return n, err
+}
@@ -0,0 +1,186 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/whiteboxvpn/cli/types"
+)
+
+const NOTIFICATIONS_BUS_NAME = "org.freedesktop.Notifications"
+const NOTIFICATIONS_OBJECT_PATH = "/org/freedesktop/Notifications"
+const NOTIFICATIONS_INTERFACE = "org.freedesktop.Notifications"
+const NOTIFICATION_APP_NAME = "White Box VPN"
+const NOTIFICATION_ICON = "network-vpn"
+
+// How long the notifier waits before it asks the daemon again after losing
+// it
+const NOTIFY_RETRY_INTERVAL = 5 * time.Second
+
+// The urgency levels of the notification specification
+const (
+	urgencyLow      byte = 0
+	urgencyNormal   byte = 1
+	urgencyCritical byte = 2
+)
+
+// notifier sends desktop notifications for the tunnels' events over the
+// session bus. A tunnel's notification replaces its previous one, so that
+// a flapping tunnel does not flood the desktop.
+type notifier struct {
+	conn *dbus.Conn
+	ids  map[string]uint32
+	last map[string]string
+}
+
+// newNotifier connects to the session bus.
+func newNotifier() (*notifier, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, err
+	}
+	return newNotifierWithConn(conn), nil
+}
+
+// newNotifierWithConn sends notifications over conn, which the notifier
+// closes when it is done.
+func newNotifierWithConn(conn *dbus.Conn) *notifier {
+	return &notifier{
+		conn: conn,
+		ids:  map[string]uint32{},
+		last: map[string]string{},
+	}
+}
+
+func (n *notifier) close() {
+	n.conn.Close()
+}
+
+// notify shows a notification, replacing the previous one with the same
+// key.
+func (n *notifier) notify(key string, summary string, body string, urgency byte) error {
+	hints := map[string]dbus.Variant{"urgency": dbus.MakeVariant(urgency)}
+	var id uint32
+	err := n.conn.Object(NOTIFICATIONS_BUS_NAME, NOTIFICATIONS_OBJECT_PATH).Call(NOTIFICATIONS_INTERFACE+".Notify", 0,
+		NOTIFICATION_APP_NAME, n.ids[key], NOTIFICATION_ICON, summary, body, []string{}, hints, int32(-1)).Store(&id)
+	if err != nil {
+		return err
+	}
+	n.ids[key] = id
+	return nil
+}
+
+// handle notifies of an event where it tells the user something new. A
+// tunnel that comes back after roaming or a resume was never lost as far
+// as the user is concerned, and a tunnel that is known to be reconnecting
+// only says so once.
+func (n *notifier) handle(event types.Event) error {
+	key := event.Tunnel
+	if len(key) == 0 {
+		key = event.ServerName
+	}
+	last := n.last[key]
+	lost := last == types.EventHandshakeStale || last == types.EventReconnecting
+
+	switch event.Kind {
+	case types.EventConnected:
+		n.last[key] = event.Kind
+		if last == types.EventConnected {
+			return nil
+		}
+		summary := "VPN connected"
+		if lost {
+			summary = "VPN reconnected"
+		}
+		return n.notify(key, summary, fmt.Sprintf("Connected to %s as tunnel %s", event.ServerName, event.Tunnel), urgencyNormal)
+	case types.EventDisconnected:
+		n.last[key] = event.Kind
+		return n.notify(key, "VPN disconnected", fmt.Sprintf("Disconnected from %s", event.ServerName), urgencyLow)
+	case types.EventHandshakeStale:
+		n.last[key] = event.Kind
+		return n.notify(key, "VPN connection lost", fmt.Sprintf("%s stopped answering, reconnecting", event.ServerName), urgencyCritical)
+	case types.EventReconnecting:
+		n.last[key] = event.Kind
+		if lost {
+			return nil
+		}
+		return n.notify(key, "VPN reconnecting", fmt.Sprintf("Reconnecting to %s", event.ServerName), urgencyCritical)
+	case types.EventError:
+		return n.notify(key, "VPN error", fmt.Sprintf("%s: %s", event.ServerName, event.Message), urgencyCritical)
+	}
+	return nil
+}
+
+// notifyEvents shows desktop notifications for the tunnels' events, for as
+// long as it runs. It is meant to run in the user's session, since the
+// daemon has no session bus to talk to. When the daemon goes away the
+// notifier says so once and waits for it to come back.
+func notifyEvents() {
+	n, err := newNotifier()
+	if err != nil {
+		log.Fatal("unable to connect to the session bus: ", err)
+	}
+	defer n.close()
+
+	handle := func(event types.Event) {
+		err := n.handle(event)
+		if err != nil {
+			log.Print("unable to show notification: ", err)
+		}
+	}
+	var cursor uint64
+	unavailable := false
+	for {
+		rpcClient, err := dialDaemon()
+		if err == nil {
+			if cursor == 0 {
+				var reply types.EventsReply
+				err = rpcClient.Call("Listener.Events", types.EventsData{}, &reply)
+				cursor = reply.Cursor
+			}
+			if err == nil {
+				unavailable = false
+				cursor, err = followEvents(rpcClient, cursor, handle)
+			}
+			rpcClient.Close()
+		}
+
+		// Trying again does not help until one of them is upgraded
+		if isVersionError(err) {
+			notifyErr := n.notify("wbd", "VPN service incompatible", err.Error(), urgencyCritical)
+			if notifyErr != nil {
+				log.Print("unable to show notification: ", notifyErr)
+			}
+			log.Fatal(err)
+		}
+		if !unavailable {
+			log.Print(daemonError(err))
+			notifyErr := n.notify("wbd", "VPN service unavailable", "The White Box VPN daemon is not answering, tunnels are not being watched", urgencyCritical)
+			if notifyErr != nil {
+				log.Print("unable to show notification: ", notifyErr)
+			}
+			unavailable = true
+		}
+		time.Sleep(NOTIFY_RETRY_INTERVAL)
+	}
+}
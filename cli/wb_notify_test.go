@@ -0,0 +1,163 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/whiteboxvpn/cli/types"
+)
+
+// startTestBus runs a private session bus for the test and returns its
+// address. The test is skipped where dbus-daemon is not installed.
+func startTestBus(t *testing.T) string {
+	path, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+	cmd := exec.Command(path, "--session", "--nofork", "--print-address")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatal("error reading the bus address: ", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+// sentNotification is what the notifier asked the notification server to
+// show.
+type sentNotification struct {
+	replaces uint32
+	summary  string
+	urgency  byte
+}
+
+// fakeNotifications is a notification server that hands out ids the way
+// the specification says, and records every notification.
+type fakeNotifications struct {
+	lock   sync.Mutex
+	nextID uint32
+	sent   []sentNotification
+}
+
+func (f *fakeNotifications) Notify(appName string, replacesID uint32, icon string, summary string, body string,
+	actions []string, hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var urgency byte
+	hints["urgency"].Store(&urgency)
+	f.sent = append(f.sent, sentNotification{replaces: replacesID, summary: summary, urgency: urgency})
+	if replacesID != 0 {
+		return replacesID, nil
+	}
+	f.nextID++
+	return f.nextID, nil
+}
+
+func (f *fakeNotifications) take() []sentNotification {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	sent := f.sent
+	f.sent = nil
+	return sent
+}
+
+func TestNotifierHandle(t *testing.T) {
+	address := startTestBus(t)
+	fake := &fakeNotifications{}
+	service, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	err = service.Export(fake, NOTIFICATIONS_OBJECT_PATH, NOTIFICATIONS_INTERFACE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := service.RequestName(NOTIFICATIONS_BUS_NAME, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("error taking the bus name: %v %v", reply, err)
+	}
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := newNotifierWithConn(conn)
+	defer n.close()
+
+	tests := []struct {
+		name  string
+		event types.Event
+		want  []sentNotification
+	}{
+		{"connected", types.Event{Kind: types.EventConnected, Tunnel: "wb0", ServerName: "a"},
+			[]sentNotification{{0, "VPN connected", urgencyNormal}}},
+		{"connected again", types.Event{Kind: types.EventConnected, Tunnel: "wb0", ServerName: "a"},
+			nil},
+		{"stale", types.Event{Kind: types.EventHandshakeStale, Tunnel: "wb0", ServerName: "a"},
+			[]sentNotification{{1, "VPN connection lost", urgencyCritical}}},
+		{"reconnecting after stale", types.Event{Kind: types.EventReconnecting, Tunnel: "wb0", ServerName: "a"},
+			nil},
+		{"reconnected", types.Event{Kind: types.EventConnected, Tunnel: "wb0", ServerName: "a"},
+			[]sentNotification{{1, "VPN reconnected", urgencyNormal}}},
+		{"other tunnel", types.Event{Kind: types.EventConnected, Tunnel: "wb1", ServerName: "b"},
+			[]sentNotification{{0, "VPN connected", urgencyNormal}}},
+		{"reconnecting", types.Event{Kind: types.EventReconnecting, Tunnel: "wb1", ServerName: "b"},
+			[]sentNotification{{2, "VPN reconnecting", urgencyCritical}}},
+		{"error before a tunnel", types.Event{Kind: types.EventError, ServerName: "c", Message: "refused"},
+			[]sentNotification{{0, "VPN error", urgencyCritical}}},
+		{"error again", types.Event{Kind: types.EventError, ServerName: "c", Message: "refused"},
+			[]sentNotification{{3, "VPN error", urgencyCritical}}},
+		{"disconnected", types.Event{Kind: types.EventDisconnected, Tunnel: "wb0", ServerName: "a"},
+			[]sentNotification{{1, "VPN disconnected", urgencyLow}}},
+	}
+	for _, test := range tests {
+		err := n.handle(test.event)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		sent := fake.take()
+		if len(sent) != len(test.want) {
+			t.Errorf("%s: sent %v, want %v", test.name, sent, test.want)
+			continue
+		}
+		for i := range sent {
+			if sent[i] != test.want[i] {
+				t.Errorf("%s: sent %v, want %v", test.name, sent[i], test.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+func status(name string, jsonOutput bool, watch bool) {
+	var tunnelStatuses []types.TunnelStatus
+
+	rpcClient, err := dialDaemon()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Subscribing before asking for the status makes sure no event in
+	// between goes missing
+	var events types.EventsReply
+	if watch {
+		err = rpcClient.Call("Listener.Events", types.EventsData{}, &events)
+		if err != nil {
+			log.Fatal(daemonError(err))
+		}
+	}
+
+	err = rpcClient.Call("Listener.Status", types.StatusData{Name: name}, &tunnelStatuses)
+	if err != nil {
+		log.Fatal(daemonError(err))
+	}
+
+	if watch {
+		printStatuses(tunnelStatuses, jsonOutput, false)
+		watchEvents(rpcClient, name, events.Cursor, jsonOutput)
+		return
+	}
+	printStatuses(tunnelStatuses, jsonOutput, true)
+}
+
+// printStatuses prints the status of the tunnels. Without indentation the
+// JSON fits on one line.
+func printStatuses(tunnelStatuses []types.TunnelStatus, jsonOutput bool, indent bool) {
+	if jsonOutput {
+		out, err := json.Marshal(tunnelStatuses)
+		if indent {
+			out, err = json.MarshalIndent(tunnelStatuses, "", "  ")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(out))
+		return
+	}
+
+	if len(tunnelStatuses) == 0 {
+		fmt.Println("disconnected")
+		return
+	}
+	for i, tunnelStatus := range tunnelStatuses {
+		if i > 0 {
+			fmt.Println()
+		}
+		printStatus(tunnelStatus)
+	}
+}
+
+// watchEvents prints the events of the tunnels as they happen, for as long
+// as the daemon runs. With a name only the events of that tunnel are
+// printed. JSON is printed one event per line.
+func watchEvents(rpcClient *rpc.Client, name string, cursor uint64, jsonOutput bool) {
+	_, err := followEvents(rpcClient, cursor, func(event types.Event) {
+		if len(name) > 0 && event.Tunnel != name && event.ServerName != name {
+			return
+		}
+		if jsonOutput {
+			out, err := json.Marshal(event)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(string(out))
+			return
+		}
+		printEvent(event)
+	})
+	log.Fatal(daemonError(err))
+}
+
+// followEvents hands the events from the cursor on to handle as they
+// happen, until asking the daemon for them fails. It returns the cursor to
+// carry on from.
+func followEvents(rpcClient *rpc.Client, cursor uint64, handle func(event types.Event)) (uint64, error) {
+	for {
+		var reply types.EventsReply
+		err := rpcClient.Call("Listener.Events", types.EventsData{Cursor: cursor}, &reply)
+		if err != nil {
+			return cursor, err
+		}
+		cursor = reply.Cursor
+		for _, event := range reply.Events {
+			handle(event)
+		}
+	}
+}
+
+// printEvent prints an event on a line of its own.
+func printEvent(event types.Event) {
+	line := event.Time.Local().Format("2006-01-02 15:04:05")
+	if len(event.Tunnel) > 0 {
+		line += " " + event.Tunnel
+	}
+	if len(event.ServerName) > 0 {
+		line += fmt.Sprintf(" (%s)", event.ServerName)
+	}
+	line += " " + event.Kind
+	if len(event.Message) > 0 {
+		line += ": " + event.Message
+	}
+	fmt.Println(line)
+}
+
+// printStatus prints the status of a single tunnel.
+func printStatus(tunnelStatus types.TunnelStatus) {
+	if !tunnelStatus.Connected {
+		fmt.Printf("%s: disconnected\n", tunnelStatus.Device)
+		if tunnelStatus.KillSwitch {
+			fmt.Printf("The kill switch is blocking all traffic, run 'wb disconnect %s' to lift it\n", tunnelStatus.Device)
+		}
+		return
+	}
+
+	handshake := "never"
+	if !tunnelStatus.LastHandshake.IsZero() {
+		ago := time.Since(tunnelStatus.LastHandshake).Round(time.Second)
+		handshake = fmt.Sprintf("%s ago", ago)
+	}
+
+	const padding = 3
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, padding, ' ', 0)
+	fmt.Fprintf(w, "Tunnel\t%s\n", tunnelStatus.Device)
+	state := tunnelStatus.State
+	if len(state) == 0 {
+		state = "connected"
+	}
+	fmt.Fprintf(w, "Status\t%s\n", state)
+	fmt.Fprintf(w, "Server\t%s\n", tunnelStatus.ServerName)
+	fmt.Fprintf(w, "Address\t%s\n", tunnelStatus.ClientAddress)
+	if len(tunnelStatus.ClientAddress6) > 0 {
+		fmt.Fprintf(w, "IPv6 Address\t%s\n", tunnelStatus.ClientAddress6)
+	} else if len(tunnelStatus.IPv6Policy) > 0 {
+		fmt.Fprintf(w, "IPv6\tblocked (%s)\n", tunnelStatus.IPv6Policy)
+	} else {
+		fmt.Fprintf(w, "IPv6\tnot tunneled\n")
+	}
+	if len(tunnelStatus.IncludeRanges) > 0 {
+		fmt.Fprintf(w, "Included\t%s\n", strings.Join(tunnelStatus.IncludeRanges, ", "))
+	}
+	if len(tunnelStatus.ExcludeRanges) > 0 {
+		fmt.Fprintf(w, "Excluded\t%s\n", strings.Join(tunnelStatus.ExcludeRanges, ", "))
+	}
+	if len(tunnelStatus.TunnelDomains) > 0 {
+		fmt.Fprintf(w, "Domains\t%s\n", strings.Join(tunnelStatus.TunnelDomains, ", "))
+	}
+	if len(tunnelStatus.Namespace) > 0 {
+		fmt.Fprintf(w, "Namespace\t%s, use wb exec -- <command>\n", tunnelStatus.Namespace)
+	}
+	if tunnelStatus.AppsOnly {
+		fmt.Fprintf(w, "Applications\tonly those started with wb exec --tunnel\n")
+	}
+	fmt.Fprintf(w, "Endpoint\t%s\n", tunnelStatus.Endpoint)
+	fmt.Fprintf(w, "Latest Handshake\t%s\n", handshake)
+	if tunnelStatus.Keepalive > 0 {
+		fmt.Fprintf(w, "Keepalive\tevery %d seconds\n", tunnelStatus.Keepalive)
+	}
+	fmt.Fprintf(w, "Received\t%s\n", formatBytes(tunnelStatus.ReceiveBytes))
+	fmt.Fprintf(w, "Sent\t%s\n", formatBytes(tunnelStatus.TransmitBytes))
+	fmt.Fprintf(w, "Kill Switch\t%s\n", onOff(tunnelStatus.KillSwitch))
+	w.Flush()
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// formatBytes formats a byte count with a binary unit suffix.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
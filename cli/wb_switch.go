@@ -0,0 +1,108 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// switchServer moves a tunnel to another server without dropping the
+// connection. The new peer is added on the new server first, the daemon
+// brings the new tunnel up next to the old one, and only once traffic has
+// moved over is the old peer removed from its server.
+func switchServer(serverName string, tunnelName string, options connectOptions) {
+
+	tunnelStatus := switchSource(tunnelName)
+	if tunnelStatus.ServerName == serverName {
+		log.Fatalf("tunnel %s is already connected to %s", tunnelStatus.Device, serverName)
+	}
+	if len(tunnelStatus.Namespace) > 0 || len(tunnelStatus.TunnelDomains) > 0 || len(options.TunnelDomains) > 0 || options.Namespace {
+		log.Fatal("namespaced tunnels and tunnels of domains cannot be switched, disconnect first")
+	}
+	checkNotConnected(serverName)
+
+	signer := sshSigner()
+	configData, peer := provisionPeer(serverName, options, signer)
+	defer peer.close()
+
+	var reply types.SwitchReply
+	rpcClient, err := dialDaemon()
+	if err != nil {
+		peer.fatal(err)
+	}
+	defer rpcClient.Close()
+	err = rpcClient.Call("Listener.SwitchTunnel", types.SwitchData{Name: tunnelStatus.Device, Config: configData}, &reply)
+	if err != nil {
+		peer.fatal(daemonError(err))
+	}
+	log.Printf("Switched to %s as tunnel %s", serverName, reply.Device)
+
+	// The old peer is no use to anyone now, but the switch worked whether
+	// or not it can be removed. The old server needs a connection of its
+	// own, through the new tunnel.
+	if len(reply.OldServerName) > 0 && len(reply.OldPublicKey) > 0 {
+		log.Printf("Removing the old peer from %s", reply.OldServerName)
+		_, _, sshClient := dialServer(reply.OldServerName, getToken(), signer)
+		defer sshClient.Close()
+		removePeer(reply.OldServerName, reply.OldPublicKey, sshClient)
+	}
+}
+
+// switchSource returns the status of the tunnel to switch away from, which
+// is the only tunnel when no name is given.
+func switchSource(tunnelName string) types.TunnelStatus {
+	var tunnelStatuses []types.TunnelStatus
+
+	rpcClient, err := dialDaemon()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rpcClient.Close()
+
+	err = rpcClient.Call("Listener.Status", types.StatusData{Name: tunnelName}, &tunnelStatuses)
+	if err != nil {
+		log.Fatal(daemonError(err))
+	}
+	if len(tunnelStatuses) == 0 {
+		log.Fatal("not connected, use wb connect instead")
+	}
+	if len(tunnelStatuses) > 1 {
+		log.Fatal("more than one tunnel is up, choose one with --tunnel")
+	}
+	return tunnelStatuses[0]
+}
+
+// removePeer removes the peer with the public key from every wireguard
+// interface of the server. Failures are only logged.
+func removePeer(serverName string, publicKey string, sshClient *ssh.Client) {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		log.Print("unable to create session: ", err)
+		return
+	}
+	defer session.Close()
+	removePeerCommandText := fmt.Sprintf("for i in $(wg show interfaces); do wg set $i peer %s remove; done", publicKey)
+	if err := session.Run(removePeerCommandText); err != nil {
+		log.Printf("failed to remove peer %s from %s: %v", publicKey, serverName, err)
+	}
+}
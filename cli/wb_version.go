@@ -0,0 +1,111 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"strings"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+// version is the version of wb, set from the VERSION file when building.
+var version = "dev"
+
+// versionError means wb and wbd speak different versions of the RPC API.
+type versionError struct {
+	message string
+}
+
+func (e *versionError) Error() string {
+	return e.message
+}
+
+// daemonVersion tells the daemon wb's version and asks for its own. Daemons
+// from before the API was versioned do not know the call, they are taken to
+// speak API version 0.
+func daemonVersion(rpcClient *rpc.Client) (types.VersionReply, error) {
+	var reply types.VersionReply
+	err := rpcClient.Call("Listener.Version", types.VersionData{Version: version, APIVersion: types.API_VERSION}, &reply)
+	if err != nil && strings.Contains(err.Error(), "can't find method") {
+		return types.VersionReply{Version: "unknown"}, nil
+	}
+	return reply, err
+}
+
+// checkVersion makes sure the daemon speaks the same version of the RPC API
+// as wb, so that a mismatch shows up as such and not as calls that fail in
+// odd ways.
+func checkVersion(rpcClient *rpc.Client) error {
+	reply, err := daemonVersion(rpcClient)
+	if err != nil {
+		return err
+	}
+	return compatible(reply)
+}
+
+// compatible returns a versionError telling which of wb and wbd to upgrade
+// when the daemon's API version differs from wb's.
+func compatible(reply types.VersionReply) error {
+	switch {
+	case reply.APIVersion < types.API_VERSION:
+		return &versionError{fmt.Sprintf("wbd %s is too old for wb %s (API version %d, wb needs %d), upgrade wbd and restart it",
+			reply.Version, version, reply.APIVersion, types.API_VERSION)}
+	case reply.APIVersion > types.API_VERSION:
+		return &versionError{fmt.Sprintf("wb %s is too old for wbd %s (API version %d, wbd needs %d), upgrade wb",
+			version, reply.Version, types.API_VERSION, reply.APIVersion)}
+	}
+	return nil
+}
+
+// printVersion prints the versions of wb and of the daemon, and fails when
+// they cannot work together.
+func printVersion() {
+	fmt.Printf("wb  %s (API version %d)\n", version, types.API_VERSION)
+
+	rpcClient, err := connectDaemon()
+	if err != nil {
+		fmt.Println("wbd not reachable:", err)
+		os.Exit(1)
+	}
+	defer rpcClient.Close()
+
+	reply, err := daemonVersion(rpcClient)
+	if err != nil {
+		fmt.Println("ERROR:", daemonError(err))
+		os.Exit(1)
+	}
+	fmt.Printf("wbd %s (API version %d)\n", reply.Version, reply.APIVersion)
+
+	err = compatible(reply)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+}
+
+// isVersionError reports whether wb failed to talk to the daemon because
+// they speak different versions of the RPC API.
+func isVersionError(err error) bool {
+	var versionErr *versionError
+	return errors.As(err, &versionErr)
+}
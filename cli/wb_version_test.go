@@ -0,0 +1,124 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+func TestCompatible(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiVersion int
+		wantErr    string
+	}{
+		{"same API version", types.API_VERSION, ""},
+		{"older daemon", types.API_VERSION - 1, "wbd 1.2.3 is too old"},
+		{"unversioned daemon", 0, "wbd 1.2.3 is too old"},
+		{"newer daemon", types.API_VERSION + 1, "too old for wbd 1.2.3"},
+	}
+	for _, test := range tests {
+		err := compatible(types.VersionReply{Version: "1.2.3", APIVersion: test.apiVersion})
+		if len(test.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if !isVersionError(err) || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: got %v, want a version error saying %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+// unversionedDaemon is a daemon from before the API was versioned, which
+// has no Version call.
+type unversionedDaemon struct{}
+
+func (d *unversionedDaemon) Status(data string, reply *types.Reply) error {
+	return nil
+}
+
+// versionedDaemon answers the Version call with its reply, or its error.
+type versionedDaemon struct {
+	reply types.VersionReply
+	err   error
+}
+
+func (d *versionedDaemon) Version(data types.VersionData, reply *types.VersionReply) error {
+	*reply = d.reply
+	return d.err
+}
+
+// testDaemon serves the RPC API with listener, over a pipe.
+func testDaemon(t *testing.T, listener interface{}) *rpc.Client {
+	server := rpc.NewServer()
+	err := server.RegisterName("Listener", listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestCheckVersion(t *testing.T) {
+	tests := []struct {
+		name           string
+		listener       interface{}
+		wantVersion    string
+		wantVersionErr bool
+		wantOtherErr   bool
+	}{
+		{"unversioned daemon is API version 0", &unversionedDaemon{}, "unknown", true, false},
+		{"same API version", &versionedDaemon{reply: types.VersionReply{Version: "1.0.0", APIVersion: types.API_VERSION}}, "1.0.0", false, false},
+		{"newer daemon", &versionedDaemon{reply: types.VersionReply{Version: "2.0.0", APIVersion: types.API_VERSION + 1}}, "2.0.0", true, false},
+		{"failing call", &versionedDaemon{err: errors.New("[internal] broken")}, "", false, true},
+	}
+	for _, test := range tests {
+		client := testDaemon(t, test.listener)
+		reply, err := daemonVersion(client)
+		if test.wantOtherErr {
+			if err == nil || isVersionError(err) {
+				t.Errorf("%s: daemonVersion gave %v, want the call's error", test.name, err)
+			}
+			continue
+		}
+		if err != nil || reply.Version != test.wantVersion {
+			t.Errorf("%s: daemonVersion gave %v, %v, want version %s", test.name, reply, err, test.wantVersion)
+			continue
+		}
+
+		err = checkVersion(client)
+		if test.wantVersionErr && !isVersionError(err) {
+			t.Errorf("%s: checkVersion gave %v, want a version error", test.name, err)
+		}
+		if !test.wantVersionErr && err != nil {
+			t.Errorf("%s: checkVersion gave %v", test.name, err)
+		}
+	}
+}
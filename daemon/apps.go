@@ -0,0 +1,210 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+// Processes launched with "wb exec" are kept in these cgroup v2 groups, one
+// per policy, below CGROUP_ROOT. Children stay in their parent's group, so
+// the policy holds for the whole process tree.
+const CGROUP_ROOT = "/sys/fs/cgroup"
+const APP_CGROUP = "whitebox"
+
+// Traffic of applications that use the tunnel carries APP_TUNNEL_MARK,
+// traffic of applications that bypass it APP_BYPASS_MARK
+const APP_TUNNEL_MARK = 0x5742
+const APP_BYPASS_MARK = 0x5743
+
+// RULE_PRIORITY_BYPASS is the priority of the rules that send bypassing
+// traffic to the main table, in front of every tunnel's rules.
+const RULE_PRIORITY_BYPASS = RULE_PRIORITY_BASE
+
+const (
+	appPolicyTunnel = "tunnel"
+	appPolicyBypass = "bypass"
+)
+
+// appMarkSpec describes how application traffic is marked while tunnels
+// are up. Traffic of the tunnel group gets the mark the rules of a tunnel
+// just for applications send through it, traffic of the bypass group gets
+// the mark the bypass rules send past every tunnel.
+type appMarkSpec struct {
+	Firewall   string `json:"firewall"`
+	TunnelMark int    `json:"tunnelMark"`
+	BypassMark int    `json:"bypassMark"`
+}
+
+// appCgroup returns the path of the policy's group, relative to the root of
+// the cgroup v2 hierarchy.
+func appCgroup(policy string) string {
+	return filepath.Join(APP_CGROUP, policy)
+}
+
+// createAppCgroups makes sure the group of every policy exists.
+func createAppCgroups() error {
+	_, err := os.Stat(filepath.Join(CGROUP_ROOT, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("no cgroup v2 hierarchy at %s: %w", CGROUP_ROOT, err)
+	}
+	for _, policy := range []string{appPolicyTunnel, appPolicyBypass} {
+		err = os.MkdirAll(filepath.Join(CGROUP_ROOT, appCgroup(policy)), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markApps has the firewall mark and masquerade application traffic and
+// adds the bypass rules, and records both in undo. They exist once for all
+// tunnels, in the undo log of one of them, and handOverAppMarks keeps them
+// around for as long as any tunnel is up.
+func markApps(undo *undoLog) error {
+	if fw == nil {
+		return noFirewallError()
+	}
+	err := createAppCgroups()
+	if err != nil {
+		return newError(types.ErrInternal, "error creating application cgroups", err)
+	}
+	err = configureIpRules(undo, bypassRules())
+	if err != nil {
+		return err
+	}
+	spec := &appMarkSpec{
+		Firewall:   fw.name(),
+		TunnelMark: APP_TUNNEL_MARK,
+		BypassMark: APP_BYPASS_MARK,
+	}
+	err = fw.markApps(spec)
+	if err == nil {
+		err = fw.masqueradeApps(spec)
+	}
+	undo.record(action{Kind: actionAppMarks, AppMarks: spec})
+	return err
+}
+
+// bypassRules returns the rules that send bypassing traffic to the main
+// table.
+func bypassRules() []ruleSpec {
+	var rules []ruleSpec
+	for _, familyNet := range []string{ALL_NETWORK_RANGE, ALL_NETWORK_RANGE6} {
+		rules = append(rules, ruleSpec{
+			Priority:          RULE_PRIORITY_BYPASS,
+			Src:               familyNet,
+			Table:             unix.RT_TABLE_MAIN,
+			Mark:              APP_BYPASS_MARK,
+			SuppressPrefixlen: -1,
+		})
+	}
+	return rules
+}
+
+// isAppAction reports whether the action is part of marking application
+// traffic.
+func isAppAction(a action) bool {
+	return a.Kind == actionAppMarks || (a.Kind == actionRule && a.Rule.Priority == RULE_PRIORITY_BYPASS)
+}
+
+// handOverAppMarks moves the application marks from a tunnel that is about
+// to be torn down to the first of the others that is up on the host, so
+// that applications started with "wb exec" do not lose their policy while
+// any tunnel is left. Without such a tunnel they go with this one.
+func handOverAppMarks(state *tunnelState, others []*tunnelState) {
+	var heir *tunnelState
+	for _, other := range others {
+		if other != state && len(other.Namespace) == 0 {
+			heir = other
+			break
+		}
+	}
+	if heir == nil || !state.hasAction(isAppAction) {
+		return
+	}
+
+	var kept []action
+	for _, a := range state.Undo.Actions {
+		if isAppAction(a) {
+			heir.Undo.record(a)
+		} else {
+			kept = append(kept, a)
+		}
+	}
+	state.Undo.Actions = kept
+	log.Printf("tunnel %s takes over application marks from %s", heir.Device, state.Device)
+	for _, s := range []*tunnelState{heir, state} {
+		err := saveState(s)
+		if err != nil {
+			log.Print("error saving tunnel state: ", err)
+		}
+	}
+}
+
+// unmarkApps stops marking and masquerading application traffic, with the
+// backend that started it or with the backend in use when spec is nil.
+func unmarkApps(spec *appMarkSpec) error {
+	backend := fw
+	if spec != nil && spec.Firewall != "" {
+		for _, f := range firewalls {
+			if f.name() == spec.Firewall && f.available() {
+				backend = f
+			}
+		}
+	}
+	if backend == nil {
+		return nil
+	}
+	return backend.unmarkApps()
+}
+
+// JoinAppPolicy moves the calling process into the group of the requested
+// policy. The caller then executes the application, which inherits the
+// group. Only callers on the Unix socket are known, so that is the only way
+// in.
+func (l *Listener) JoinAppPolicy(data types.AppPolicyData, reply *types.Reply) error {
+	if l.peer == nil {
+		return newError(types.ErrInternal, "application policies need a connection on the Unix socket", nil)
+	}
+	if data.Policy != appPolicyTunnel && data.Policy != appPolicyBypass {
+		return newError(types.ErrInvalidConfig, fmt.Sprintf("unknown application policy %q", data.Policy), nil)
+	}
+
+	err := createAppCgroups()
+	if err != nil {
+		return logError("JoinAppPolicy", newError(types.ErrInternal, "error creating application cgroups", err))
+	}
+	procs := filepath.Join(CGROUP_ROOT, appCgroup(data.Policy), "cgroup.procs")
+	err = os.WriteFile(procs, []byte(strconv.Itoa(int(l.peer.Pid))), 0644)
+	if err != nil {
+		return logError("JoinAppPolicy", newError(types.ErrInternal, "error moving process to application cgroup", err))
+	}
+
+	log.Printf("process %d (uid %d) now uses the %s policy", l.peer.Pid, l.peer.Uid, data.Policy)
+	*reply = types.Reply{Data: data.Policy}
+	return nil
+}
@@ -0,0 +1,195 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+// tunnelRanges works out the ranges that go through the tunnel: the included
+// ranges, or everything the tunnel has an address for when there are none,
+// less the excluded ranges. When domains are tunneled, nothing is routed up
+// front but the DNS servers that resolve them. The DNS servers of a tunnel
+// for some ranges go through it as well, as the system sends its lookups to
+// them over the tunnel's link.
+func tunnelRanges(configData types.ConfigData) ([]netip.Prefix, error) {
+	include, err := parsePrefixes(configData.IncludeRanges)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := parsePrefixes(configData.ExcludeRanges)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(configData.TunnelDomains) > 0 || len(include) > 0 {
+		servers, err := parsePrefixes(configData.DNSServers)
+		if err != nil {
+			return nil, err
+		}
+		for _, server := range servers {
+			if server.Addr().Is4() || len(configData.ClientAddress6) > 0 {
+				include = append(include, server)
+			}
+		}
+	} else {
+		include = familyRanges(configData)
+	}
+	for _, prefix := range include {
+		if prefix.Addr().Is6() && len(configData.ClientAddress6) == 0 {
+			msg := fmt.Sprintf("cannot route %s, the server has no IPv6 range", prefix)
+			return nil, newError(types.ErrInvalidConfig, msg, nil)
+		}
+	}
+	routed := subtractPrefixes(include, exclude)
+	if len(routed) == 0 {
+		return nil, newError(types.ErrInvalidConfig, "the excluded ranges leave nothing to send through the tunnel", nil)
+	}
+	return routed, nil
+}
+
+// leakRanges returns the IPv6 ranges that would bypass a tunnel that routes
+// all IPv4 traffic but has no IPv6 address, leaving out the excluded ones.
+// Tunnels that only route some ranges have none.
+func leakRanges(configData types.ConfigData) []netip.Prefix {
+	if len(configData.ClientAddress6) > 0 || len(configData.IncludeRanges) > 0 || len(configData.TunnelDomains) > 0 {
+		return nil
+	}
+	exclude, err := parsePrefixes(configData.ExcludeRanges)
+	if err != nil {
+		return nil
+	}
+	return subtractPrefixes([]netip.Prefix{netip.MustParsePrefix(ALL_NETWORK_RANGE6)}, exclude)
+}
+
+// familyRanges returns the whole address space of each address family the
+// tunnel has an address for.
+func familyRanges(configData types.ConfigData) []netip.Prefix {
+	families := []netip.Prefix{netip.MustParsePrefix(ALL_NETWORK_RANGE)}
+	if len(configData.ClientAddress6) > 0 {
+		families = append(families, netip.MustParsePrefix(ALL_NETWORK_RANGE6))
+	}
+	return families
+}
+
+// anyInFamily reports whether any of the ranges is part of family.
+func anyInFamily(prefixes []netip.Prefix, family netip.Prefix) bool {
+	for _, prefix := range prefixes {
+		if family.Overlaps(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses a list of CIDR ranges, a bare address being a range
+// of its own.
+func parsePrefixes(ranges []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, r := range ranges {
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(r)
+			if addrErr != nil {
+				return nil, newError(types.ErrInvalidConfig, "error parsing range "+r, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// subtractPrefixes returns the ranges that cover everything in include that
+// is not in exclude. An excluded range only applies to included ranges as
+// large as or larger than itself, so a smaller range can be included back
+// from an excluded one. Ranges that overlap an excluded range are split in
+// halves until the halves are either inside it or clear of it.
+func subtractPrefixes(include, exclude []netip.Prefix) []netip.Prefix {
+	var pieces []netip.Prefix
+	var subtract func(prefix netip.Prefix, exclude []netip.Prefix)
+	subtract = func(prefix netip.Prefix, exclude []netip.Prefix) {
+		overlaps := false
+		for _, e := range exclude {
+			if !e.Overlaps(prefix) {
+				continue
+			}
+			if e.Bits() <= prefix.Bits() {
+				return
+			}
+			overlaps = true
+		}
+		if !overlaps {
+			pieces = append(pieces, prefix)
+			return
+		}
+		low, high := splitPrefix(prefix)
+		subtract(low, exclude)
+		subtract(high, exclude)
+	}
+
+	for _, prefix := range include {
+		var applies []netip.Prefix
+		for _, e := range exclude {
+			if e.Bits() >= prefix.Bits() {
+				applies = append(applies, e)
+			}
+		}
+		subtract(prefix, applies)
+	}
+
+	var result []netip.Prefix
+	for i := range pieces {
+		if !coveredByOther(pieces, i) {
+			result = append(result, pieces[i])
+		}
+	}
+	return result
+}
+
+// coveredByOther reports whether a larger range, or an earlier copy of the
+// same range, already covers ranges[i].
+func coveredByOther(ranges []netip.Prefix, i int) bool {
+	prefix := ranges[i]
+	for j, r := range ranges {
+		if j == i {
+			continue
+		}
+		if r.Bits() < prefix.Bits() && r.Contains(prefix.Addr()) {
+			return true
+		}
+		if r == prefix && j < i {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPrefix splits a range into its two halves.
+func splitPrefix(prefix netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := prefix.Bits() + 1
+	addr := prefix.Addr().AsSlice()
+	low := netip.PrefixFrom(prefix.Addr(), bits)
+	addr[prefix.Bits()/8] |= 0x80 >> (prefix.Bits() % 8)
+	highAddr, _ := netip.AddrFromSlice(addr)
+	return low, netip.PrefixFrom(highAddr, bits)
+}
@@ -0,0 +1,115 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+func prefixes(ranges ...string) []netip.Prefix {
+	var result []netip.Prefix
+	for _, r := range ranges {
+		result = append(result, netip.MustParsePrefix(r))
+	}
+	return result
+}
+
+func TestSubtractPrefixes(t *testing.T) {
+	allBut10 := []string{"0.0.0.0/5", "8.0.0.0/7", "11.0.0.0/8", "12.0.0.0/6",
+		"16.0.0.0/4", "32.0.0.0/3", "64.0.0.0/2", "128.0.0.0/1"}
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{"nothing excluded", []string{"0.0.0.0/0"}, nil, []string{"0.0.0.0/0"}},
+		{"range excluded", []string{"0.0.0.0/0"}, []string{"10.0.0.0/8"}, allBut10},
+		{"include inside exclude", []string{"10.1.0.0/16"}, []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}},
+		{"include inside exclude next to everything else", []string{"0.0.0.0/0", "10.1.0.0/16"}, []string{"10.0.0.0/8"},
+			append(append([]string{}, allBut10...), "10.1.0.0/16")},
+		{"exclude of everything", []string{"0.0.0.0/0"}, []string{"0.0.0.0/0"}, nil},
+		{"exclude of everything leaves smaller includes", []string{"10.0.0.0/8"}, []string{"0.0.0.0/0"}, []string{"10.0.0.0/8"}},
+		{"exclude inside a small range", []string{"192.168.0.0/30"}, []string{"192.168.0.1/32"},
+			[]string{"192.168.0.0/32", "192.168.0.2/31"}},
+		{"exclude clear of the include", []string{"10.0.0.0/8"}, []string{"192.168.0.0/16"}, []string{"10.0.0.0/8"}},
+		{"exclude of the other family", []string{"0.0.0.0/0"}, []string{"::/0"}, []string{"0.0.0.0/0"}},
+		{"IPv6", []string{"fd00::/126"}, []string{"fd00::/128"}, []string{"fd00::1/128", "fd00::2/127"}},
+		{"duplicate includes", []string{"10.0.0.0/8", "10.0.0.0/8"}, nil, []string{"10.0.0.0/8"}},
+		{"include covered by another", []string{"10.1.0.0/16", "10.0.0.0/8"}, nil, []string{"10.0.0.0/8"}},
+	}
+	for _, test := range tests {
+		got := subtractPrefixes(prefixes(test.include...), prefixes(test.exclude...))
+		want := prefixes(test.want...)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func TestTunnelRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  types.ConfigData
+		want    []string
+		wantErr bool
+	}{
+		{"everything", types.ConfigData{ClientAddress: "10.64.0.2"},
+			[]string{"0.0.0.0/0"}, false},
+		{"everything with IPv6", types.ConfigData{ClientAddress: "10.64.0.2", ClientAddress6: "fd00::2"},
+			[]string{"0.0.0.0/0", "::/0"}, false},
+		{"include routes the DNS servers", types.ConfigData{IncludeRanges: []string{"10.0.0.0/8"}, DNSServers: []string{"100.64.0.1"}},
+			[]string{"10.0.0.0/8", "100.64.0.1/32"}, false},
+		{"include that covers the DNS servers", types.ConfigData{IncludeRanges: []string{"10.0.0.0/8"}, DNSServers: []string{"10.64.0.1"}},
+			[]string{"10.0.0.0/8"}, false},
+		{"IPv6 DNS server without an IPv6 address", types.ConfigData{IncludeRanges: []string{"10.0.0.0/8"}, DNSServers: []string{"fd00::1"}},
+			[]string{"10.0.0.0/8"}, false},
+		{"tunneled domains route only the DNS servers", types.ConfigData{TunnelDomains: []string{"corp.example"}, DNSServers: []string{"100.64.0.1"}},
+			[]string{"100.64.0.1/32"}, false},
+		{"include inside exclude", types.ConfigData{IncludeRanges: []string{"10.1.0.0/16"}, ExcludeRanges: []string{"10.0.0.0/8"}},
+			[]string{"10.1.0.0/16"}, false},
+		{"exclude of everything", types.ConfigData{ExcludeRanges: []string{"0.0.0.0/0"}},
+			nil, true},
+		{"exclude of every included range", types.ConfigData{IncludeRanges: []string{"10.1.0.0/16"}, ExcludeRanges: []string{"10.1.0.0/16"}},
+			nil, true},
+		{"IPv6 range without an IPv6 address", types.ConfigData{IncludeRanges: []string{"fd00::/8"}},
+			nil, true},
+		{"invalid range", types.ConfigData{IncludeRanges: []string{"10.0.0.0/33"}},
+			nil, true},
+	}
+	for _, test := range tests {
+		got, err := tunnelRanges(test.config)
+		if test.wantErr {
+			var rpcErr *types.RPCError
+			if !errors.As(err, &rpcErr) || rpcErr.Code != types.ErrInvalidConfig {
+				t.Errorf("%s: got %v, %v, want an invalid config error", test.name, got, err)
+			}
+			continue
+		}
+		want := prefixes(test.want...)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, %v, want %v", test.name, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+// reconcile compares the system against the states of the tunnels that are
+// up and removes the links, rules and routes that look like they were made
+// by the daemon but are not part of any of them. They are left behind when
+// the daemon dies half way through bringing a tunnel up or down. Without
+// states no tunnel should be up, so everything the daemon owns is removed.
+func reconcile(states []*tunnelState) error {
+	var firstErr error
+	fail := func(err error) {
+		log.Print(err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	expectedDevices := map[string]bool{}
+	var expectedRules []ruleSpec
+	var expectedRoutes []routeSpec
+	expectedKillSwitch := false
+	expectedAppMarks := false
+	expectedDNS := false
+	expectedNamespace := false
+	for _, state := range states {
+		expectedDevices[state.Device] = true
+		for _, a := range state.Undo.Actions {
+			switch a.Kind {
+			case actionLink:
+				expectedDevices[a.Device] = true
+			case actionRule:
+				expectedRules = append(expectedRules, *a.Rule)
+			case actionRoute:
+				expectedRoutes = append(expectedRoutes, *a.Route)
+			case actionKillSwitch:
+				expectedKillSwitch = true
+			case actionAppMarks:
+				expectedAppMarks = true
+			case actionDNS:
+				expectedDNS = true
+			case actionNamespace:
+				expectedNamespace = true
+			}
+		}
+	}
+
+	// Wireguard links named like the daemon's own. Deleting a link also
+	// removes all routes through it.
+	links, err := netlink.LinkList()
+	if err != nil {
+		return newError(types.ErrInternal, "error listing links", err)
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "wireguard" || !strings.HasPrefix(name, DEVICE_PREFIX) || expectedDevices[name] {
+			continue
+		}
+		log.Printf("removing stale link %s", name)
+		err = netlink.LinkDel(link)
+		if err != nil && !isNotExist(err) {
+			fail(newError(types.ErrInternal, "error deleting stale link", err))
+		}
+	}
+
+	// Rules in the daemon's priority band, remembering the tables they used
+	staleTables := map[int]bool{}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return newError(types.ErrInternal, "error listing rules", err)
+		}
+		for _, rule := range rules {
+			if !ownedRule(rule) || matchesAnyRule(rule, family, expectedRules) {
+				continue
+			}
+			rule := rule
+			rule.Family = family
+			if !systemTable(rule.Table) {
+				staleTables[rule.Table] = true
+			}
+			log.Printf("removing stale rule %s", rule)
+			err = netlink.RuleDel(&rule)
+			if err != nil && !isNotExist(err) {
+				fail(newError(types.ErrInternal, "error deleting stale rule", err))
+			}
+		}
+	}
+
+	// Routes through the tunnel's link in tables other than the system ones
+	for device := range expectedDevices {
+		link, err := netlink.LinkByName(device)
+		if err != nil {
+			continue
+		}
+		filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: unix.RT_TABLE_UNSPEC}
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			fail(newError(types.ErrInternal, "error listing routes", err))
+			continue
+		}
+		for _, route := range routes {
+			if systemTable(route.Table) || matchesAnyRoute(route, device, expectedRoutes) {
+				continue
+			}
+			route := route
+			log.Printf("removing stale route %s", route)
+			err = netlink.RouteDel(&route)
+			if err != nil && !isNotExist(err) {
+				fail(newError(types.ErrInternal, "error deleting stale route", err))
+			}
+		}
+	}
+
+	// Routes without a device, such as the ones blocking IPv6, in the
+	// tables of stale rules
+	for _, route := range expectedRoutes {
+		delete(staleTables, route.Table)
+	}
+	for table := range staleTables {
+		filter := &netlink.Route{Table: table}
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			fail(newError(types.ErrInternal, "error listing routes", err))
+			continue
+		}
+		for _, route := range routes {
+			if route.Type != unix.RTN_UNREACHABLE && route.Type != unix.RTN_BLACKHOLE {
+				continue
+			}
+			route := route
+			log.Printf("removing stale route %s", route)
+			err = netlink.RouteDel(&route)
+			if err != nil && !isNotExist(err) {
+				fail(newError(types.ErrInternal, "error deleting stale route", err))
+			}
+		}
+	}
+
+	if !expectedKillSwitch {
+		err = disableKillSwitch(nil)
+		if err != nil {
+			fail(err)
+		}
+	}
+	if !expectedAppMarks {
+		err = unmarkApps(nil)
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	// A namespace left behind by a namespaced tunnel
+	if !expectedNamespace {
+		err = deleteNamespace(NETNS_NAME, "")
+		if err != nil && !isNotExist(err) {
+			fail(newError(types.ErrInternal, "error deleting stale network namespace", err))
+		}
+	}
+
+	// A resolv.conf backup nobody is going to restore
+	backup := resolvConfBackupPath()
+	_, err = os.Stat(backup)
+	if !expectedDNS && err == nil {
+		log.Printf("restoring resolv.conf from stale backup %s", backup)
+		err = restoreResolvConf(&dnsSpec{Backup: backup})
+		if err != nil {
+			fail(newError(types.ErrInternal, "error restoring resolv.conf", err))
+		}
+	}
+
+	return firstErr
+}
+
+// reconcileOnStartup checks the tunnel states a previous run left behind
+// against the system. A tunnel whose link has disappeared is torn down,
+// apart from its kill switch which stays until the user disconnects, then
+// anything stale is removed. It returns the states that are still valid.
+func reconcileOnStartup(states []*tunnelState) []*tunnelState {
+	var up, gone []*tunnelState
+	for _, state := range states {
+		var err error
+		if len(state.Namespace) > 0 {
+			if !namespaceLinkExists(state.Namespace, state.Device) {
+				err = os.ErrNotExist
+			}
+		} else {
+			_, err = netlink.LinkByName(state.Device)
+		}
+		if err == nil {
+			up = append(up, state)
+			if len(state.Config.ClientPrivateKey) == 0 {
+				log.Printf("the state of tunnel %s does not hold its configuration, it stays up during sleep", state.Device)
+			}
+		} else {
+			gone = append(gone, state)
+		}
+	}
+
+	valid := up
+	for _, state := range gone {
+		log.Printf("link %s of a saved tunnel is gone, tearing the tunnel down", state.Device)
+		handOverAppMarks(state, up)
+		err := state.Undo.rollbackExcept(actionKillSwitch)
+		if err != nil {
+			log.Print("error tearing down the saved tunnel: ", err)
+		}
+		if len(state.Undo.Actions) > 0 {
+			valid = append(valid, state)
+			err = saveState(state)
+		} else {
+			err = removeState(state)
+		}
+		if err != nil {
+			log.Print("error updating tunnel state: ", err)
+		}
+	}
+
+	err := reconcile(valid)
+	if err != nil {
+		log.Print("error removing stale network configuration: ", err)
+	}
+
+	// The forwarder went away with the previous daemon, but the system is
+	// still pointed at it
+	for _, state := range valid {
+		for _, a := range state.Undo.Actions {
+			if a.Kind == actionForwarder {
+				err = runForwarder(a.Forwarder)
+				if err != nil {
+					log.Print("error restarting DNS forwarder: ", err)
+				}
+			}
+		}
+	}
+	return valid
+}
+
+// cleanup tears down the saved tunnels and everything else the daemon owns.
+// It backs the "wbd cleanup" command, which recovers a machine whose network
+// configuration was broken by the daemon.
+func cleanup() error {
+	states, err := loadStates()
+	if err != nil {
+		log.Print("error loading tunnel state, removing it: ", err)
+	}
+	for _, state := range states {
+		err = state.Undo.rollback()
+		if err != nil {
+			log.Print("error tearing down a saved tunnel: ", err)
+		}
+		err = removeState(state)
+		if err != nil {
+			return err
+		}
+	}
+
+	// States that could not be read
+	err = os.RemoveAll(filepath.Dir(stateFilePath("")))
+	if err != nil {
+		return err
+	}
+	err = clearFirewalls()
+	if err != nil {
+		return err
+	}
+	return reconcile(nil)
+}
+
+// ownedRule reports whether the rule is in the daemon's priority band.
+func ownedRule(rule netlink.Rule) bool {
+	return rule.Priority >= RULE_PRIORITY_BASE && rule.Priority < RULE_PRIORITY_BASE+RULE_PRIORITY_COUNT
+}
+
+func matchesAnyRule(rule netlink.Rule, family int, specs []ruleSpec) bool {
+	for _, spec := range specs {
+		expected, err := spec.netlinkRule()
+		if err != nil {
+			continue
+		}
+		if ipFamily(expected.Src.IP) == family &&
+			rule.Priority == expected.Priority &&
+			rule.Table == expected.Table &&
+			rule.Mark == expected.Mark &&
+			rule.Invert == expected.Invert &&
+			rule.SuppressPrefixlen == expected.SuppressPrefixlen &&
+			sameNet(rule.Src, expected.Src) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyRoute(route netlink.Route, device string, specs []routeSpec) bool {
+	for _, spec := range specs {
+		if spec.Device != device || spec.Table != route.Table {
+			continue
+		}
+		_, dst, err := net.ParseCIDR(spec.Dst)
+		if err == nil && sameNet(route.Dst, dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameNet compares two networks, treating a missing network as the whole
+// address space the way the kernel reports rules without a source.
+func sameNet(a, b *net.IPNet) bool {
+	return netString(a) == netString(b)
+}
+
+func netString(n *net.IPNet) string {
+	if n == nil {
+		return ""
+	}
+	ones, _ := n.Mask.Size()
+	if ones == 0 {
+		return ""
+	}
+	return n.String()
+}
+
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// systemTable reports whether the table is one of the tables the kernel
+// maintains itself.
+func systemTable(table int) bool {
+	return table == unix.RT_TABLE_MAIN || table == unix.RT_TABLE_LOCAL || table == unix.RT_TABLE_DEFAULT
+}
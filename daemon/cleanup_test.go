@@ -0,0 +1,147 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestOwnedRule(t *testing.T) {
+	tests := []struct {
+		priority int
+		want     bool
+	}{
+		{RULE_PRIORITY_BASE - 1, false},
+		{RULE_PRIORITY_BASE, true},
+		{RULE_PRIORITY_TUNNELS, true},
+		{RULE_PRIORITY_BASE + RULE_PRIORITY_COUNT - 1, true},
+		{RULE_PRIORITY_BASE + RULE_PRIORITY_COUNT, false},
+		{0, false},
+		{32766, false},
+	}
+	for _, test := range tests {
+		rule := netlink.NewRule()
+		rule.Priority = test.priority
+		got := ownedRule(*rule)
+		if got != test.want {
+			t.Errorf("ownedRule(priority %d) = %v, want %v", test.priority, got, test.want)
+		}
+	}
+}
+
+// kernelRule is a rule the way the kernel lists it, without a source when
+// it applies to every address.
+func kernelRule(priority int, src string, table int, mark int, invert bool, suppress int) netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Priority = priority
+	if len(src) > 0 {
+		_, rule.Src, _ = net.ParseCIDR(src)
+	}
+	rule.Table = table
+	rule.Mark = mark
+	rule.Invert = invert
+	rule.SuppressPrefixlen = suppress
+	return *rule
+}
+
+func TestMatchesAnyRule(t *testing.T) {
+	specs := []ruleSpec{
+		{Priority: 31010, Src: "0.0.0.0/0", Table: 0x57420100, Mark: 0x57420100, Invert: true, SuppressPrefixlen: -1},
+		{Priority: 31011, Src: "0.0.0.0/0", Table: 254, Mark: -1, SuppressPrefixlen: 0},
+		{Priority: 31010, Src: "::/0", Table: 0x57420100, Mark: 0x57420100, Invert: true, SuppressPrefixlen: -1},
+		{Priority: 31020, Src: "10.0.0.0/8", Table: 0x57420101, Mark: -1, SuppressPrefixlen: -1},
+	}
+	tests := []struct {
+		name   string
+		rule   netlink.Rule
+		family int
+		want   bool
+	}{
+		{"inverted mark rule", kernelRule(31010, "", 0x57420100, 0x57420100, true, -1), netlink.FAMILY_V4, true},
+		{"suppress rule", kernelRule(31011, "", 254, -1, false, 0), netlink.FAMILY_V4, true},
+		{"IPv6 rule", kernelRule(31010, "", 0x57420100, 0x57420100, true, -1), netlink.FAMILY_V6, true},
+		{"IPv6 rule that was only added for IPv4", kernelRule(31011, "", 254, -1, false, 0), netlink.FAMILY_V6, false},
+		{"rule with a source", kernelRule(31020, "10.0.0.0/8", 0x57420101, -1, false, -1), netlink.FAMILY_V4, true},
+		{"other source", kernelRule(31020, "10.1.0.0/16", 0x57420101, -1, false, -1), netlink.FAMILY_V4, false},
+		{"other priority", kernelRule(31012, "", 254, -1, false, 0), netlink.FAMILY_V4, false},
+		{"other table", kernelRule(31010, "", 0x57420101, 0x57420100, true, -1), netlink.FAMILY_V4, false},
+		{"other mark", kernelRule(31010, "", 0x57420100, 0x57420101, true, -1), netlink.FAMILY_V4, false},
+		{"not inverted", kernelRule(31010, "", 0x57420100, 0x57420100, false, -1), netlink.FAMILY_V4, false},
+		{"no suppression", kernelRule(31011, "", 254, -1, false, -1), netlink.FAMILY_V4, false},
+	}
+	for _, test := range tests {
+		got := matchesAnyRule(test.rule, test.family, specs)
+		if got != test.want {
+			t.Errorf("%s: matchesAnyRule = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatchesAnyRoute(t *testing.T) {
+	specs := []routeSpec{
+		{Dst: "0.0.0.0/0", Device: "wb0", Table: 0x57420100},
+		{Dst: "10.0.0.0/8", Device: "wb0", Table: 0x57420100},
+		{Dst: "::/0", Device: "wb1", Table: 0x57420101},
+	}
+	route := func(dst string, table int) netlink.Route {
+		_, ipNet, _ := net.ParseCIDR(dst)
+		return netlink.Route{Dst: ipNet, Table: table}
+	}
+	tests := []struct {
+		name   string
+		route  netlink.Route
+		device string
+		want   bool
+	}{
+		{"default route", netlink.Route{Table: 0x57420100}, "wb0", true},
+		{"range", route("10.0.0.0/8", 0x57420100), "wb0", true},
+		{"IPv6 default route", netlink.Route{Table: 0x57420101}, "wb1", true},
+		{"other range", route("10.0.0.0/16", 0x57420100), "wb0", false},
+		{"other device", route("10.0.0.0/8", 0x57420100), "wb1", false},
+		{"other table", route("10.0.0.0/8", 0x57420101), "wb0", false},
+	}
+	for _, test := range tests {
+		got := matchesAnyRoute(test.route, test.device, specs)
+		if got != test.want {
+			t.Errorf("%s: matchesAnyRoute = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSystemTable(t *testing.T) {
+	tests := []struct {
+		table int
+		want  bool
+	}{
+		{253, true},
+		{254, true},
+		{255, true},
+		{0x57420100, false},
+		{100, false},
+	}
+	for _, test := range tests {
+		got := systemTable(test.table)
+		if got != test.want {
+			t.Errorf("systemTable(%d) = %v, want %v", test.table, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const DEFAULT_CONFIG_PATH = "/etc/whitebox/wbd.json"
+
+// daemonConfig holds the settings an administrator can make persistent in
+// the daemon's configuration file.
+type daemonConfig struct {
+	// KillSwitch enables the kill switch for every tunnel, whether or not
+	// the client asks for it.
+	KillSwitch bool `json:"killSwitch"`
+
+	// IPv6LeakProtection decides what happens to IPv6 traffic while the
+	// tunnel only carries IPv4: "reject" makes it fail straight away,
+	// "blackhole" silently drops it and "off" lets it bypass the tunnel.
+	// It defaults to "reject".
+	IPv6LeakProtection string `json:"ipv6LeakProtection"`
+
+	// TableRangeStart and TableRangeEnd bound the ids the daemon picks
+	// routing tables and firewall marks from, both included. Ids that are
+	// already in use by anything else are skipped. They default to
+	// DEFAULT_TABLE_RANGE_START and DEFAULT_TABLE_RANGE_END.
+	TableRangeStart int `json:"tableRangeStart"`
+	TableRangeEnd   int `json:"tableRangeEnd"`
+
+	// SleepPolicy decides what happens to the tunnels when the system goes
+	// to sleep: "keep" leaves them up and has them handshake again on
+	// resume, "disconnect" takes them down before sleep and brings them up
+	// again after. Tunnels with a kill switch are always kept, so that
+	// nothing leaks before they are back. It defaults to "keep".
+	SleepPolicy string `json:"sleepPolicy"`
+}
+
+// The default range stays clear of wg-quick's 51820 and of the tables and
+// marks of other common VPNs.
+const DEFAULT_TABLE_RANGE_START = 0x57420100
+const DEFAULT_TABLE_RANGE_END = 0x574201ff
+
+const (
+	ipv6PolicyReject    = "reject"
+	ipv6PolicyBlackhole = "blackhole"
+	ipv6PolicyOff       = "off"
+)
+
+const (
+	sleepPolicyKeep       = "keep"
+	sleepPolicyDisconnect = "disconnect"
+)
+
+// config is the daemon's configuration, loaded at startup.
+var config = defaultConfig()
+
+func defaultConfig() daemonConfig {
+	return daemonConfig{
+		IPv6LeakProtection: ipv6PolicyReject,
+		TableRangeStart:    DEFAULT_TABLE_RANGE_START,
+		TableRangeEnd:      DEFAULT_TABLE_RANGE_END,
+		SleepPolicy:        sleepPolicyKeep,
+	}
+}
+
+// loadConfig reads the configuration file. A missing file gives the default
+// configuration.
+func loadConfig(path string) (daemonConfig, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	switch cfg.IPv6LeakProtection {
+	case "":
+		cfg.IPv6LeakProtection = ipv6PolicyReject
+	case ipv6PolicyReject, ipv6PolicyBlackhole, ipv6PolicyOff:
+	default:
+		return cfg, fmt.Errorf("invalid ipv6LeakProtection %q", cfg.IPv6LeakProtection)
+	}
+
+	switch cfg.SleepPolicy {
+	case "":
+		cfg.SleepPolicy = sleepPolicyKeep
+	case sleepPolicyKeep, sleepPolicyDisconnect:
+	default:
+		return cfg, fmt.Errorf("invalid sleepPolicy %q", cfg.SleepPolicy)
+	}
+
+	// The kernel's own tables and the application marks are off limits
+	if cfg.TableRangeStart <= unix.RT_TABLE_LOCAL || cfg.TableRangeEnd < cfg.TableRangeStart {
+		return cfg, fmt.Errorf("invalid table range %d-%d", cfg.TableRangeStart, cfg.TableRangeEnd)
+	}
+	for _, mark := range []int{APP_TUNNEL_MARK, APP_BYPASS_MARK} {
+		if cfg.TableRangeStart <= mark && mark <= cfg.TableRangeEnd {
+			return cfg, fmt.Errorf("table range %d-%d includes the application mark %d", cfg.TableRangeStart, cfg.TableRangeEnd, mark)
+		}
+	}
+	return cfg, nil
+}
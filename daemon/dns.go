@@ -0,0 +1,144 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+const (
+	dnsMethodResolved   = "resolved"
+	dnsMethodResolvConf = "resolvconf"
+)
+
+// dnsSpec describes the DNS configuration applied for a tunnel, and how to
+// restore what was there before.
+type dnsSpec struct {
+	Method  string   `json:"method"`
+	Device  string   `json:"device"`
+	Servers []string `json:"servers"`
+	Domains []string `json:"domains"`
+
+	// Where the original resolv.conf was saved, and the target it pointed
+	// to when it was a symbolic link
+	Backup     string `json:"backup,omitempty"`
+	LinkTarget string `json:"linkTarget,omitempty"`
+}
+
+// configureDNS points the system's resolver at the tunnel's DNS servers,
+// through systemd-resolved when it manages the system's DNS and by
+// rewriting /etc/resolv.conf otherwise. The change is recorded in undo.
+func configureDNS(undo *undoLog, device string, servers []string, domains []string) error {
+	spec := &dnsSpec{
+		Device:  device,
+		Servers: servers,
+		Domains: domains,
+	}
+
+	resolved, err := newResolvedDNS()
+	if err == nil && resolved.managesResolvConf() {
+		defer resolved.close()
+		spec.Method = dnsMethodResolved
+		undo.record(action{Kind: actionDNS, DNS: spec})
+		return resolved.apply(spec)
+	}
+	if resolved != nil {
+		resolved.close()
+	}
+
+	// There is only one resolv.conf, the first tunnel to rewrite it keeps
+	// it until that tunnel goes away
+	if owner := resolvConfOwner(device); owner != nil {
+		log.Printf("resolv.conf already belongs to tunnel %s, not using the DNS servers of %s", owner.Device, device)
+		return nil
+	}
+	spec.Method = dnsMethodResolvConf
+	err = backupResolvConf(spec)
+	if err != nil {
+		return newError(types.ErrInternal, "error saving resolv.conf", err)
+	}
+	undo.record(action{Kind: actionDNS, DNS: spec})
+	err = writeResolvConf(spec)
+	if err != nil {
+		return newError(types.ErrInternal, "error writing resolv.conf", err)
+	}
+	return nil
+}
+
+// updateDNS points the resolver configured by spec at other servers and
+// search domains, without putting back what was there before in between.
+func updateDNS(spec *dnsSpec, servers []string, domains []string) error {
+	spec.Servers = servers
+	spec.Domains = domains
+	switch spec.Method {
+	case dnsMethodResolved:
+		resolved, err := newResolvedDNS()
+		if err != nil {
+			return newError(types.ErrInternal, "error connecting to systemd-resolved", err)
+		}
+		defer resolved.close()
+		return resolved.apply(spec)
+	case dnsMethodResolvConf:
+		err := writeResolvConf(spec)
+		if err != nil {
+			return newError(types.ErrInternal, "error writing resolv.conf", err)
+		}
+	}
+	return nil
+}
+
+// resolvConfOwner returns the tunnel, other than the one on device, that
+// rewrote resolv.conf, or nil.
+func resolvConfOwner(device string) *tunnelState {
+	for _, state := range sortedTunnels() {
+		if state.Device == device {
+			continue
+		}
+		for _, a := range state.Undo.Actions {
+			if a.Kind == actionDNS && a.DNS.Method == dnsMethodResolvConf {
+				return state
+			}
+		}
+	}
+	return nil
+}
+
+// restoreDNS reverts the DNS configuration described by spec.
+func restoreDNS(spec *dnsSpec) error {
+	switch spec.Method {
+	case dnsMethodResolved:
+		resolved, err := newResolvedDNS()
+		if err != nil {
+			return newError(types.ErrInternal, "error connecting to systemd-resolved", err)
+		}
+		defer resolved.close()
+		return resolved.revert(spec)
+	case dnsMethodResolvConf:
+		err := restoreResolvConf(spec)
+		if err != nil {
+			return newError(types.ErrInternal, "error restoring resolv.conf", err)
+		}
+		return nil
+	default:
+		log.Printf("unknown DNS method %q, nothing to restore", spec.Method)
+		return nil
+	}
+}
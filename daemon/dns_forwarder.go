@@ -0,0 +1,345 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netlink"
+	"github.com/whiteboxvpn/cli/types"
+)
+
+// Host routes live at least this long, so that short TTLs do not make them
+// come and go while connections are still open
+const MIN_HOST_ROUTE_TTL = 5 * time.Minute
+
+// How often expired host routes are looked for
+const HOST_ROUTE_SWEEP_INTERVAL = 30 * time.Second
+
+// forwarderSpec describes the DNS forwarder of a tunnel. It answers the
+// system's queries on the tunnel's own address by asking the upstream
+// servers, and routes the addresses it sees for the tunneled domains
+// through the tunnel.
+type forwarderSpec struct {
+	Address   string   `json:"address"`
+	Upstreams []string `json:"upstreams"`
+	Domains   []string `json:"domains"`
+	Device    string   `json:"device"`
+	Table     int      `json:"table"`
+	IPv6      bool     `json:"ipv6"`
+}
+
+// dnsForwarder is a running DNS forwarder.
+type dnsForwarder struct {
+	spec      forwarderSpec
+	udpClient *dns.Client
+	tcpClient *dns.Client
+	servers   []*dns.Server
+	done      chan struct{}
+
+	// Expiry of the host routes added so far
+	lock   sync.Mutex
+	routes map[netip.Addr]time.Time
+}
+
+// forwarders holds the running forwarders by the address they answer on.
+var forwarders = map[string]*dnsForwarder{}
+
+// startForwarder starts answering queries on the address of spec, over UDP
+// and TCP, and records it in undo.
+func startForwarder(undo *undoLog, spec *forwarderSpec) error {
+	err := runForwarder(spec)
+	if err != nil {
+		return err
+	}
+	undo.record(action{Kind: actionForwarder, Forwarder: spec})
+	return nil
+}
+
+// runForwarder starts the forwarder without recording it, which is how the
+// forwarder of a tunnel restored at startup comes back.
+func runForwarder(spec *forwarderSpec) error {
+	if forwarders[spec.Address] != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("a DNS forwarder already answers on %s", spec.Address), nil)
+	}
+	f := newForwarder(spec)
+	for _, network := range []string{"udp", "tcp"} {
+		started := make(chan struct{})
+		server := &dns.Server{
+			Addr:              spec.Address,
+			Net:               network,
+			Handler:           f,
+			NotifyStartedFunc: func() { close(started) },
+		}
+		failed := make(chan error, 1)
+		go func() {
+			failed <- server.ListenAndServe()
+		}()
+		select {
+		case <-started:
+		case err := <-failed:
+			f.shutdown()
+			return newError(types.ErrInternal, "error starting DNS forwarder", err)
+		}
+		f.servers = append(f.servers, server)
+	}
+
+	go f.expireRoutes()
+	forwarders[spec.Address] = f
+	return nil
+}
+
+// newForwarder sets up a forwarder for spec that does not answer queries
+// yet.
+func newForwarder(spec *forwarderSpec) *dnsForwarder {
+	return &dnsForwarder{
+		spec:      *spec,
+		udpClient: &dns.Client{Net: "udp", Timeout: 5 * time.Second},
+		tcpClient: &dns.Client{Net: "tcp", Timeout: 5 * time.Second},
+		done:      make(chan struct{}),
+		routes:    map[netip.Addr]time.Time{},
+	}
+}
+
+// stopForwarder stops the forwarder of spec and removes the host routes it
+// added.
+func stopForwarder(spec *forwarderSpec) error {
+	f := forwarders[spec.Address]
+	if f == nil {
+		return nil
+	}
+	delete(forwarders, spec.Address)
+	close(f.done)
+	f.shutdown()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var firstErr error
+	for addr := range f.routes {
+		err := f.deleteRoute(addr)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	f.routes = map[netip.Addr]time.Time{}
+	return firstErr
+}
+
+func (f *dnsForwarder) shutdown() {
+	for _, server := range f.servers {
+		err := server.Shutdown()
+		if err != nil {
+			log.Print("error stopping DNS forwarder: ", err)
+		}
+	}
+}
+
+// ServeDNS answers a query with the upstream servers' answer, after routing
+// the addresses in it when the query is for a tunneled domain. Answers over
+// UDP are truncated to the size the client takes.
+func (f *dnsForwarder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp, err := f.exchange(req)
+	if err != nil {
+		log.Print("error forwarding DNS query: ", err)
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(resp)
+		return
+	}
+
+	if len(req.Question) > 0 && f.tunneled(req.Question[0].Name) {
+		if !f.spec.IPv6 {
+			// The tunnel cannot carry these, and they must not go around it
+			resp.Answer = withoutType(resp.Answer, dns.TypeAAAA)
+		}
+		f.routeAnswers(resp.Answer)
+	}
+
+	// An answer that came over TCP can be larger than the client takes over
+	// UDP, which then has to ask again over TCP
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		opt := req.IsEdns0()
+		if opt != nil {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+	w.WriteMsg(resp)
+}
+
+// exchange asks each upstream server in turn until one answers, over TCP
+// when the UDP answer is truncated. Upstream servers are addresses, with an
+// optional port.
+func (f *dnsForwarder) exchange(req *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+	for _, upstream := range f.spec.Upstreams {
+		address := upstream
+		_, _, err := net.SplitHostPort(upstream)
+		if err != nil {
+			address = net.JoinHostPort(upstream, "53")
+		}
+		resp, _, err := f.udpClient.Exchange(req, address)
+		if err == nil && resp.Truncated {
+			resp, _, err = f.tcpClient.Exchange(req, address)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstream DNS servers")
+	}
+	return nil, lastErr
+}
+
+// tunneled reports whether name is one of the tunneled domains or below
+// one of them.
+func (f *dnsForwarder) tunneled(name string) bool {
+	for _, domain := range f.spec.Domains {
+		domain = strings.TrimPrefix(domain, "*.")
+		if dns.IsSubDomain(dns.Fqdn(domain), dns.Fqdn(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeAnswers adds or extends a host route through the tunnel for every
+// address in the answer, lasting as long as the record.
+func (f *dnsForwarder) routeAnswers(answer []dns.RR) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, rr := range answer {
+		var ip net.IP
+		switch record := rr.(type) {
+		case *dns.A:
+			ip = record.A
+		case *dns.AAAA:
+			ip = record.AAAA
+		default:
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		if ttl < MIN_HOST_ROUTE_TTL {
+			ttl = MIN_HOST_ROUTE_TTL
+		}
+		expiry := time.Now().Add(ttl)
+		if current, ok := f.routes[addr]; ok {
+			if current.Before(expiry) {
+				f.routes[addr] = expiry
+			}
+			continue
+		}
+
+		err := f.addRoute(addr)
+		if err != nil {
+			log.Printf("error routing %s through the tunnel: %v", addr, err)
+			continue
+		}
+		f.routes[addr] = expiry
+	}
+}
+
+// expireRoutes removes host routes whose records have expired, until the
+// forwarder is stopped.
+func (f *dnsForwarder) expireRoutes() {
+	ticker := time.NewTicker(HOST_ROUTE_SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case now := <-ticker.C:
+			f.expire(now)
+		}
+	}
+}
+
+// expire removes the host routes that expired by now.
+func (f *dnsForwarder) expire(now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for addr, expiry := range f.routes {
+		if expiry.After(now) {
+			continue
+		}
+		err := f.deleteRoute(addr)
+		if err != nil {
+			log.Printf("error removing route to %s: %v", addr, err)
+			continue
+		}
+		delete(f.routes, addr)
+	}
+}
+
+func (f *dnsForwarder) hostRoute(addr netip.Addr) routeSpec {
+	return routeSpec{
+		Dst:    netip.PrefixFrom(addr, addr.BitLen()).String(),
+		Device: f.spec.Device,
+		Table:  f.spec.Table,
+	}
+}
+
+func (f *dnsForwarder) addRoute(addr netip.Addr) error {
+	spec := f.hostRoute(addr)
+	route, err := spec.netlinkRoute()
+	if err != nil {
+		return err
+	}
+	return netlink.RouteReplace(route)
+}
+
+func (f *dnsForwarder) deleteRoute(addr netip.Addr) error {
+	spec := f.hostRoute(addr)
+	route, err := spec.netlinkRoute()
+	if err == nil {
+		err = netlink.RouteDel(route)
+	}
+	if err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// withoutType returns the records that are not of type t.
+func withoutType(records []dns.RR, t uint16) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype != t {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
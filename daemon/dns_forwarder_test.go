@@ -0,0 +1,339 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func TestForwarderTunneled(t *testing.T) {
+	f := newForwarder(&forwarderSpec{Domains: []string{"corp.example", "*.internal", "vpn.example."}})
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"corp.example.", true},
+		{"corp.example", true},
+		{"host.corp.example.", true},
+		{"a.b.corp.example.", true},
+		{"notcorp.example.", false},
+		{"example.", false},
+		{"host.internal.", true},
+		{"internal.", true},
+		{"internal.example.", false},
+		{"vpn.example.", true},
+		{"CORP.Example.", true},
+	}
+	for _, test := range tests {
+		got := f.tunneled(test.name)
+		if got != test.want {
+			t.Errorf("tunneled(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestForwarderRegistry(t *testing.T) {
+	spec := &forwarderSpec{Address: "127.0.0.1:0"}
+	err := runForwarder(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runForwarder(spec)
+	if err == nil {
+		t.Error("a second forwarder started on the same address")
+	}
+	err = stopForwarder(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwarders) > 0 {
+		t.Errorf("forwarders left after stopping: %v", forwarders)
+	}
+	err = stopForwarder(spec)
+	if err != nil {
+		t.Error("stopping a stopped forwarder: ", err)
+	}
+}
+
+// answerWriter keeps the answer the forwarder writes to a client at remote.
+type answerWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *answerWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *answerWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+// testRecords is what the test upstream answers, by name.
+var testRecords = map[string][]string{
+	"short.corp.example.": {"short.corp.example. 60 IN A 10.1.2.3", "short.corp.example. 60 IN AAAA fd00::3"},
+	"long.corp.example.":  {"long.corp.example. 3600 IN A 10.1.2.4"},
+	"www.other.example.":  {"www.other.example. 60 IN A 192.0.2.1"},
+}
+
+func serveTestRecords(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for _, record := range testRecords[req.Question[0].Name] {
+		rr, err := dns.NewRR(record)
+		if err == nil {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	w.WriteMsg(resp)
+}
+
+// serveLargeAnswer answers with many records over TCP, and with a truncated
+// answer without any over UDP.
+func serveLargeAnswer(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		resp.Truncated = true
+		w.WriteMsg(resp)
+		return
+	}
+	for i := 0; i < 200; i++ {
+		rr, err := dns.NewRR(fmt.Sprintf("%s 60 IN A 192.0.2.%d", req.Question[0].Name, i))
+		if err == nil {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	w.WriteMsg(resp)
+}
+
+// TestForwarderTruncates has the upstream answer over TCP after a truncated
+// answer over UDP, and checks that clients over UDP get no more than they
+// take.
+func TestForwarderTruncates(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		t.Skip("no TCP port to go with the UDP one: ", err)
+	}
+	handler := dns.HandlerFunc(serveLargeAnswer)
+	for _, upstream := range []*dns.Server{{PacketConn: conn, Handler: handler}, {Listener: listener, Handler: handler}} {
+		go upstream.ActivateAndServe()
+		defer upstream.Shutdown()
+	}
+	f := newForwarder(&forwarderSpec{Upstreams: []string{conn.LocalAddr().String()}})
+
+	tests := []struct {
+		name      string
+		remote    net.Addr
+		edns      uint16
+		size      int
+		truncated bool
+	}{
+		{"UDP without EDNS", &net.UDPAddr{}, 0, dns.MinMsgSize, true},
+		{"UDP with a small EDNS size", &net.UDPAddr{}, 1232, 1232, true},
+		{"UDP with a large EDNS size", &net.UDPAddr{}, dns.MaxMsgSize, dns.MaxMsgSize, false},
+		{"TCP", &net.TCPAddr{}, 0, dns.MaxMsgSize, false},
+	}
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("large.example.", dns.TypeA)
+		if test.edns > 0 {
+			req.SetEdns0(test.edns, false)
+		}
+		w := &answerWriter{remote: test.remote}
+		f.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s: no answer: %v", test.name, w.msg)
+		}
+		if w.msg.Len() > test.size || w.msg.Truncated != test.truncated {
+			t.Errorf("%s: answer of %d bytes, truncated %v, want at most %d bytes, truncated %v",
+				test.name, w.msg.Len(), w.msg.Truncated, test.size, test.truncated)
+		}
+		if !test.truncated && len(w.msg.Answer) != 200 {
+			t.Errorf("%s: %d records, want all 200", test.name, len(w.msg.Answer))
+		}
+	}
+}
+
+// enterTestNamespace moves the test onto a thread in a network namespace of
+// its own, with loopback up and one end of a veth pair for the tunnel.
+func enterTestNamespace(t *testing.T, device string) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skip("unable to create a network namespace: ", err)
+	}
+	t.Cleanup(func() {
+		netns.Set(origin)
+		origin.Close()
+		ns.Close()
+		runtime.UnlockOSThread()
+	})
+
+	lo, err := netlink.LinkByName("lo")
+	if err == nil {
+		err = netlink.LinkSetUp(lo)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: device}, PeerName: device + "p"}
+	if err == nil {
+		err = netlink.LinkAdd(veth)
+	}
+	if err == nil {
+		err = netlink.LinkSetUp(veth)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// goInTestNamespace runs fn in a goroutine of its own in the test's network
+// namespace, and returns a channel that is closed once fn returned. The
+// goroutine's thread is left locked, so that it goes away with the goroutine
+// instead of going back to the runtime in the namespace.
+func goInTestNamespace(t *testing.T, fn func()) <-chan struct{} {
+	ns, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ns.Close()
+		runtime.LockOSThread()
+		err := netns.Set(ns)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fn()
+	}()
+	return done
+}
+
+// tableRoutes is the IPv4 destinations in the routing table.
+func tableRoutes(t *testing.T, table int) map[string]bool {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsts := map[string]bool{}
+	for _, route := range routes {
+		dsts[route.Dst.String()] = true
+	}
+	return dsts
+}
+
+func TestForwarderHostRoutes(t *testing.T) {
+	const table = 100
+	enterTestNamespace(t, "wbtest0")
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(serveTestRecords)}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	f := newForwarder(&forwarderSpec{
+		Upstreams: []string{conn.LocalAddr().String()},
+		Domains:   []string{"corp.example"},
+		Device:    "wbtest0",
+		Table:     table,
+	})
+	start := time.Now()
+	for _, name := range []string{"short.corp.example.", "long.corp.example.", "www.other.example."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		w := &answerWriter{}
+		f.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("no answer for %s: %v", name, w.msg)
+		}
+		for _, rr := range w.msg.Answer {
+			if rr.Header().Rrtype == dns.TypeAAAA {
+				t.Errorf("AAAA record for %s passed a tunnel without IPv6", name)
+			}
+		}
+	}
+
+	routes := tableRoutes(t, table)
+	for _, dst := range []string{"10.1.2.3/32", "10.1.2.4/32"} {
+		if !routes[dst] {
+			t.Errorf("no host route to %s, routes are %v", dst, routes)
+		}
+	}
+	if routes["192.0.2.1/32"] {
+		t.Error("an address outside the tunneled domains was routed")
+	}
+	if len(f.routes) != 2 {
+		t.Errorf("forwarder tracks %v, want two routes", f.routes)
+	}
+
+	// A 60 second record lives as long as the minimum, an hour long one as
+	// long as the record
+	short := f.routes[netip.MustParseAddr("10.1.2.3")]
+	if short.Before(start.Add(MIN_HOST_ROUTE_TTL)) || short.After(time.Now().Add(MIN_HOST_ROUTE_TTL)) {
+		t.Errorf("short record expires at %v, want the minimum TTL after %v", short, start)
+	}
+	long := f.routes[netip.MustParseAddr("10.1.2.4")]
+	if long.Before(start.Add(time.Hour)) || long.After(time.Now().Add(time.Hour)) {
+		t.Errorf("long record expires at %v, want an hour after %v", long, start)
+	}
+
+	f.expire(start.Add(MIN_HOST_ROUTE_TTL - time.Second))
+	if len(tableRoutes(t, table)) != 2 {
+		t.Error("a route expired before its record")
+	}
+	f.expire(time.Now().Add(MIN_HOST_ROUTE_TTL + time.Second))
+	routes = tableRoutes(t, table)
+	if routes["10.1.2.3/32"] || !routes["10.1.2.4/32"] {
+		t.Errorf("after the minimum TTL routes are %v, want only 10.1.2.4/32", routes)
+	}
+	f.expire(time.Now().Add(2 * time.Hour))
+	if len(tableRoutes(t, table)) != 0 || len(f.routes) != 0 {
+		t.Errorf("routes left after every record expired: %v", f.routes)
+	}
+}
@@ -0,0 +1,129 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolvConfPath is the resolver configuration rewritten when
+// systemd-resolved is not in charge of DNS.
+var resolvConfPath = "/etc/resolv.conf"
+
+// backupResolvConf saves the current resolv.conf in the state directory, or
+// remembers its target when it is a symbolic link.
+func backupResolvConf(spec *dnsSpec) error {
+	info, err := os.Lstat(resolvConfPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		spec.LinkTarget, err = os.Readlink(resolvConfPath)
+		return err
+	}
+
+	data, err := os.ReadFile(resolvConfPath)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(stateDir, 0700)
+	if err != nil {
+		return err
+	}
+	spec.Backup = resolvConfBackupPath()
+	return os.WriteFile(spec.Backup, data, info.Mode().Perm())
+}
+
+func resolvConfBackupPath() string {
+	return filepath.Join(stateDir, "resolv.conf.backup")
+}
+
+// writeResolvConf atomically replaces resolv.conf with one that only uses
+// the tunnel's DNS servers.
+func writeResolvConf(spec *dnsSpec) error {
+	return replaceFile(resolvConfPath, resolvConfContent(spec), 0644)
+}
+
+// resolvConfContent is a resolv.conf that only uses the tunnel's DNS
+// servers.
+func resolvConfContent(spec *dnsSpec) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by White Box VPN for %s, restored on disconnect\n", spec.Device)
+	for _, server := range spec.Servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(spec.Domains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(spec.Domains, " "))
+	}
+	return []byte(b.String())
+}
+
+// restoreResolvConf puts back the resolv.conf saved by backupResolvConf.
+func restoreResolvConf(spec *dnsSpec) error {
+	if spec.LinkTarget != "" {
+		tmpPath := resolvConfPath + ".wbtmp"
+		os.Remove(tmpPath)
+		err := os.Symlink(spec.LinkTarget, tmpPath)
+		if err != nil {
+			return err
+		}
+		return os.Rename(tmpPath, resolvConfPath)
+	}
+
+	if spec.Backup == "" {
+		// There was no resolv.conf to begin with
+		err := os.Remove(resolvConfPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := os.ReadFile(spec.Backup)
+	if os.IsNotExist(err) {
+		// Already restored
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = replaceFile(resolvConfPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Remove(spec.Backup)
+}
+
+// replaceFile writes a file next to path and renames it into place, so that
+// readers never see a partial file.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".wbtmp"
+	err := os.WriteFile(tmpPath, data, perm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,161 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/vishvananda/netlink"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+const RESOLVED_BUS_NAME = "org.freedesktop.resolve1"
+const RESOLVED_OBJECT_PATH = "/org/freedesktop/resolve1"
+const RESOLVED_MANAGER = "org.freedesktop.resolve1.Manager"
+const RESOLVED_STUB_ADDRESS = "127.0.0.53"
+
+// resolvedDNS configures per-link DNS through systemd-resolved's D-Bus API.
+type resolvedDNS struct {
+	conn *dbus.Conn
+}
+
+// resolvedAddress is the (iay) structure SetLinkDNS takes.
+type resolvedAddress struct {
+	Family  int32
+	Address []byte
+}
+
+// resolvedDomain is the (sb) structure SetLinkDomains takes.
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+// newResolvedDNS connects to systemd-resolved on the system bus. It fails
+// when resolved is not running.
+func newResolvedDNS() (*resolvedDNS, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return newResolvedDNSWithConn(conn)
+}
+
+// newResolvedDNSWithConn checks that resolved is on the bus conn is
+// connected to. The connection is closed when it is not.
+func newResolvedDNSWithConn(conn *dbus.Conn) (*resolvedDNS, error) {
+	var hasOwner bool
+	err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, RESOLVED_BUS_NAME).Store(&hasOwner)
+	if err == nil && !hasOwner {
+		err = fmt.Errorf("%s is not running", RESOLVED_BUS_NAME)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &resolvedDNS{conn: conn}, nil
+}
+
+func (r *resolvedDNS) close() {
+	r.conn.Close()
+}
+
+// managesResolvConf reports whether /etc/resolv.conf sends queries to
+// resolved, otherwise per-link settings would have no effect.
+func (r *resolvedDNS) managesResolvConf() bool {
+	target, err := filepath.EvalSymlinks(resolvConfPath)
+	if err == nil && strings.HasPrefix(target, "/run/systemd/resolve/") {
+		return true
+	}
+	data, err := os.ReadFile(resolvConfPath)
+	return err == nil && strings.Contains(string(data), "nameserver "+RESOLVED_STUB_ADDRESS)
+}
+
+func (r *resolvedDNS) manager() dbus.BusObject {
+	return r.conn.Object(RESOLVED_BUS_NAME, RESOLVED_OBJECT_PATH)
+}
+
+// apply sets the tunnel's DNS servers on its link and makes the link the
+// default route for all lookups, so that no query goes to another link.
+func (r *resolvedDNS) apply(spec *dnsSpec) error {
+	ifindex, err := linkIndex(spec.Device)
+	if err != nil {
+		return err
+	}
+
+	var addresses []resolvedAddress
+	for _, server := range spec.Servers {
+		ip := net.ParseIP(server)
+		if ip == nil {
+			return newError(types.ErrInvalidConfig, fmt.Sprintf("invalid DNS server %q", server), nil)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			addresses = append(addresses, resolvedAddress{Family: unix.AF_INET, Address: ip4})
+		} else {
+			addresses = append(addresses, resolvedAddress{Family: unix.AF_INET6, Address: ip})
+		}
+	}
+
+	domains := []resolvedDomain{{Domain: ".", RoutingOnly: true}}
+	for _, domain := range spec.Domains {
+		domains = append(domains, resolvedDomain{Domain: domain})
+	}
+
+	err = r.manager().Call(RESOLVED_MANAGER+".SetLinkDNS", 0, ifindex, addresses).Err
+	if err != nil {
+		return newError(types.ErrInternal, "error setting link DNS servers", err)
+	}
+	err = r.manager().Call(RESOLVED_MANAGER+".SetLinkDomains", 0, ifindex, domains).Err
+	if err != nil {
+		return newError(types.ErrInternal, "error setting link DNS domains", err)
+	}
+
+	// Older versions of resolved do not know about default routes and
+	// already use the "~." domain for that
+	r.manager().Call(RESOLVED_MANAGER+".SetLinkDefaultRoute", 0, ifindex, true)
+	return nil
+}
+
+// revert drops the DNS settings of the tunnel's link. A link that is gone
+// has no settings left.
+func (r *resolvedDNS) revert(spec *dnsSpec) error {
+	ifindex, err := linkIndex(spec.Device)
+	if err != nil {
+		return err
+	}
+	err = r.manager().Call(RESOLVED_MANAGER+".RevertLink", 0, ifindex).Err
+	if err != nil {
+		return newError(types.ErrInternal, "error reverting link DNS", err)
+	}
+	return nil
+}
+
+func linkIndex(device string) (int32, error) {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return 0, err
+	}
+	return int32(link.Attrs().Index), nil
+}
@@ -0,0 +1,199 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+// startTestBus runs a private session bus for the test and returns its
+// address. The test is skipped where dbus-daemon is not installed.
+func startTestBus(t *testing.T) string {
+	path, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+	cmd := exec.Command(path, "--session", "--nofork", "--print-address")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatal("error reading the bus address: ", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+func connectTestBus(t *testing.T, address string) *dbus.Conn {
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// fakeResolved records what the daemon sets through resolved's Manager
+// interface.
+type fakeResolved struct {
+	lock         sync.Mutex
+	dns          map[int32][]resolvedAddress
+	domains      map[int32][]resolvedDomain
+	defaultRoute map[int32]bool
+}
+
+func (f *fakeResolved) SetLinkDNS(ifindex int32, addresses []resolvedAddress) *dbus.Error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.dns[ifindex] = addresses
+	return nil
+}
+
+func (f *fakeResolved) SetLinkDomains(ifindex int32, domains []resolvedDomain) *dbus.Error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.domains[ifindex] = domains
+	return nil
+}
+
+func (f *fakeResolved) SetLinkDefaultRoute(ifindex int32, enable bool) *dbus.Error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.defaultRoute[ifindex] = enable
+	return nil
+}
+
+func (f *fakeResolved) RevertLink(ifindex int32) *dbus.Error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.dns, ifindex)
+	delete(f.domains, ifindex)
+	delete(f.defaultRoute, ifindex)
+	return nil
+}
+
+func TestResolvedNotRunning(t *testing.T) {
+	address := startTestBus(t)
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newResolvedDNSWithConn(conn)
+	if err == nil {
+		t.Fatal("expected an error without resolved on the bus")
+	}
+}
+
+func TestResolvedLinkDNS(t *testing.T) {
+	address := startTestBus(t)
+	fake := &fakeResolved{
+		dns:          map[int32][]resolvedAddress{},
+		domains:      map[int32][]resolvedDomain{},
+		defaultRoute: map[int32]bool{},
+	}
+	service := connectTestBus(t, address)
+	err := service.Export(fake, RESOLVED_OBJECT_PATH, RESOLVED_MANAGER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := service.RequestName(RESOLVED_BUS_NAME, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("error taking the bus name: %v %v", reply, err)
+	}
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newResolvedDNSWithConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	ifindex, err := linkIndex("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &dnsSpec{
+		Device:  "lo",
+		Servers: []string{"10.64.0.1", "fd00::1"},
+		Domains: []string{"corp.example"},
+	}
+	err = r.apply(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.lock.Lock()
+	dns := fake.dns[ifindex]
+	domains := fake.domains[ifindex]
+	defaultRoute := fake.defaultRoute[ifindex]
+	fake.lock.Unlock()
+
+	wantDNS := []resolvedAddress{
+		{Family: unix.AF_INET, Address: []byte{10, 64, 0, 1}},
+		{Family: unix.AF_INET6, Address: []byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+	}
+	if !reflect.DeepEqual(dns, wantDNS) {
+		t.Errorf("link DNS = %v, want %v", dns, wantDNS)
+	}
+	wantDomains := []resolvedDomain{{Domain: ".", RoutingOnly: true}, {Domain: "corp.example"}}
+	if !reflect.DeepEqual(domains, wantDomains) {
+		t.Errorf("link domains = %v, want %v", domains, wantDomains)
+	}
+	if !defaultRoute {
+		t.Error("link is not the default route for lookups")
+	}
+
+	err = r.revert(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.lock.Lock()
+	_, found := fake.dns[ifindex]
+	fake.lock.Unlock()
+	if found {
+		t.Error("link DNS was not reverted")
+	}
+
+	err = r.apply(&dnsSpec{Device: "lo", Servers: []string{"not-an-address"}})
+	var rpcErr *types.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != types.ErrInvalidConfig {
+		t.Errorf("invalid server gave %v, want an invalid config error", err)
+	}
+}
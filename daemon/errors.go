@@ -0,0 +1,54 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+// newError wraps an error from netlink or wgctrl into an RPCError that is
+// sent back to the client. The given code is used unless the underlying
+// errno says more about what went wrong.
+func newError(code types.ErrorCode, msg string, err error) error {
+	if err == nil {
+		return &types.RPCError{Code: code, Message: msg}
+	}
+	var rpcErr *types.RPCError
+	if errors.As(err, &rpcErr) {
+		return err
+	}
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+		code = types.ErrPermissionDenied
+	}
+	return &types.RPCError{Code: code, Message: fmt.Sprintf("%s: %v", msg, err)}
+}
+
+// logError logs an error before it is returned to the client, so failures
+// show up in the daemon's log as well.
+func logError(method string, err error) error {
+	if err != nil {
+		log.Printf("%s failed: %v", method, err)
+	}
+	return err
+}
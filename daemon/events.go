@@ -0,0 +1,100 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+// How many events the daemon keeps for subscribers that fall behind, and
+// how long it waits for an event before replying without any
+const EVENT_BUFFER_SIZE = 256
+const EVENT_WAIT = 30 * time.Second
+
+// events holds the latest events, and eventsChanged is closed and replaced
+// whenever one is added, which wakes up the subscribers waiting for it.
+var eventLock sync.Mutex
+var events []types.Event
+var eventSeq uint64
+var eventsChanged = make(chan struct{})
+
+// emitEvent records an event of a tunnel. A tunnel that failed to come up
+// only has a server name.
+func emitEvent(kind string, tunnel string, serverName string, message string) {
+	event := types.Event{
+		Time:       time.Now(),
+		Kind:       kind,
+		Tunnel:     tunnel,
+		ServerName: serverName,
+		Message:    message,
+	}
+
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	eventSeq++
+	event.Seq = eventSeq
+	events = append(events, event)
+	if len(events) > EVENT_BUFFER_SIZE {
+		events = events[len(events)-EVENT_BUFFER_SIZE:]
+	}
+	close(eventsChanged)
+	eventsChanged = make(chan struct{})
+}
+
+// Events is a subscription to the tunnels' events by long polling: it
+// replies with the events from the cursor on as soon as there are any, or
+// without events after EVENT_WAIT. A subscriber that fell behind by more
+// than EVENT_BUFFER_SIZE events misses the oldest ones.
+func (l *Listener) Events(data types.EventsData, reply *types.EventsReply) error {
+	timeout := time.After(EVENT_WAIT)
+	for {
+		eventLock.Lock()
+		cursor := eventSeq + 1
+		changed := eventsChanged
+
+		// A cursor from before the daemon restarted starts over
+		from := data.Cursor
+		if from > cursor {
+			from = 0
+		}
+		var newer []types.Event
+		if data.Cursor > 0 {
+			for _, event := range events {
+				if event.Seq >= from {
+					newer = append(newer, event)
+				}
+			}
+		}
+		eventLock.Unlock()
+
+		if data.Cursor == 0 || len(newer) > 0 {
+			*reply = types.EventsReply{Events: newer, Cursor: cursor}
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			*reply = types.EventsReply{Cursor: cursor}
+			return nil
+		}
+	}
+}
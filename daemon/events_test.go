@@ -0,0 +1,93 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+// resetEvents starts the events over, as a freshly started daemon has
+// them, with count events emitted.
+func resetEvents(count int) {
+	eventLock.Lock()
+	events = nil
+	eventSeq = 0
+	eventLock.Unlock()
+	for i := 0; i < count; i++ {
+		emitEvent(types.EventConnected, "wb0", "server", "")
+	}
+}
+
+func TestEventsCursor(t *testing.T) {
+	tests := []struct {
+		name      string
+		emitted   int
+		cursor    uint64
+		wantFirst uint64
+		wantCount int
+		wantNext  uint64
+	}{
+		{"subscribing", 3, 0, 0, 0, 4},
+		{"following", 3, 2, 2, 2, 4},
+		{"everything missed", 3, 1, 1, 3, 4},
+		{"behind by less than the buffer after a wrap", 300, 290, 290, 11, 301},
+		{"behind by more than the buffer", 300, 10, 300 - EVENT_BUFFER_SIZE + 1, EVENT_BUFFER_SIZE, 301},
+		{"cursor from before a daemon restart", 3, 500, 1, 3, 4},
+		{"cursor from before a restart after a wrap", 300, 1000, 300 - EVENT_BUFFER_SIZE + 1, EVENT_BUFFER_SIZE, 301},
+	}
+	for _, test := range tests {
+		resetEvents(test.emitted)
+		var reply types.EventsReply
+		err := (&Listener{}).Events(types.EventsData{Cursor: test.cursor}, &reply)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(reply.Events) != test.wantCount || reply.Cursor != test.wantNext {
+			t.Errorf("%s: got %d events and cursor %d, want %d events and cursor %d",
+				test.name, len(reply.Events), reply.Cursor, test.wantCount, test.wantNext)
+			continue
+		}
+		for i, event := range reply.Events {
+			if event.Seq != test.wantFirst+uint64(i) {
+				t.Errorf("%s: event %d has sequence number %d, want %d", test.name, i, event.Seq, test.wantFirst+uint64(i))
+				break
+			}
+		}
+	}
+}
+
+func TestEventsWait(t *testing.T) {
+	resetEvents(3)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		emitEvent(types.EventDisconnected, "wb0", "server", "")
+	}()
+
+	var reply types.EventsReply
+	err := (&Listener{}).Events(types.EventsData{Cursor: 4}, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Events) != 1 || reply.Events[0].Kind != types.EventDisconnected || reply.Cursor != 5 {
+		t.Errorf("got %v and cursor %d, want the event emitted while waiting and cursor 5", reply.Events, reply.Cursor)
+	}
+}
@@ -0,0 +1,116 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+// A firewall is a backend that manages the daemon's firewall rules. All
+// rules a backend makes are kept apart from everybody else's, so that they
+// can be replaced and removed without touching anything else.
+type firewall interface {
+	// name identifies the backend in logs and on the command line.
+	name() string
+
+	// available reports whether the backend can be used on this machine.
+	available() bool
+
+	// enableKillSwitch installs a kill switch that lets the traffic of
+	// every tunnel in specs through, replacing any kill switch that is
+	// already there.
+	enableKillSwitch(specs []*killSwitchSpec) error
+
+	// disableKillSwitch removes the kill switch. A kill switch that is not
+	// there counts as removed.
+	disableKillSwitch() error
+
+	// markApps marks the traffic of the application cgroups described by
+	// spec, replacing any marking that is already there.
+	markApps(spec *appMarkSpec) error
+
+	// masqueradeApps gives marked application traffic the address of the
+	// interface the mark sends it out of, replacing any masquerading that
+	// is already there.
+	masqueradeApps(spec *appMarkSpec) error
+
+	// unmarkApps stops marking and masquerading application traffic.
+	// Marking that is not there counts as removed.
+	unmarkApps() error
+
+	// clear removes every rule the backend made.
+	clear() error
+}
+
+// firewalls lists the known backends, most preferred first.
+var firewalls = []firewall{
+	&nftablesFirewall{},
+	&iptablesFirewall{},
+}
+
+// fw is the backend picked at startup. It is nil when no backend is
+// available.
+var fw firewall
+
+// selectFirewall picks the backend with the given name, or the first one
+// available on this machine when the name is "auto".
+func selectFirewall(backendName string) (firewall, error) {
+	for _, backend := range firewalls {
+		if backendName != "auto" && backend.name() != backendName {
+			continue
+		}
+		if backend.available() {
+			return backend, nil
+		}
+		if backendName != "auto" {
+			return nil, fmt.Errorf("firewall backend %s is not available", backendName)
+		}
+	}
+	if backendName != "auto" {
+		return nil, fmt.Errorf("unknown firewall backend %s", backendName)
+	}
+	log.Print("no firewall backend available, the kill switch is disabled")
+	return nil, nil
+}
+
+// clearFirewalls removes the rules of every available backend, so that
+// nothing is left behind when the backend in use changed between runs.
+func clearFirewalls() error {
+	var firstErr error
+	for _, backend := range firewalls {
+		if !backend.available() {
+			continue
+		}
+		err := backend.clear()
+		if err != nil {
+			log.Printf("error clearing %s rules: %v", backend.name(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func noFirewallError() error {
+	return newError(types.ErrInternal, "no firewall backend is available, install nftables or iptables", nil)
+}
@@ -0,0 +1,277 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/whiteboxvpn/cli/types"
+)
+
+const KILL_SWITCH_CHAIN = "WHITEBOX-KILLSWITCH"
+const APP_MARK_CHAIN = "WHITEBOX-APPS"
+
+// A chain's new rules are built in a chain with this suffix before they
+// replace the chain's
+const NEW_CHAIN_SUFFIX = "-NEW"
+
+// iptablesFirewall manages the daemon's rules with the iptables and
+// ip6tables commands. The rules live in chains of their own that are hooked
+// into the built-in chains.
+type iptablesFirewall struct{}
+
+var iptablesProtocols = []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6}
+
+func (f *iptablesFirewall) name() string {
+	return "iptables"
+}
+
+func (f *iptablesFirewall) available() bool {
+	for _, proto := range iptablesProtocols {
+		_, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// killSwitchRules returns the rules of the kill switch chain for IPv4 and
+// IPv6. The tunnels' endpoints are IPv4, so IPv6 only gets to use loopback,
+// the tunnels, the excluded ranges and applications that bypass the
+// tunnels.
+func (f *iptablesFirewall) killSwitchRules(specs []*killSwitchSpec) (map[iptables.Protocol][][]string, error) {
+	comment := func(text string) []string {
+		return []string{"-m", "comment", "--comment", text}
+	}
+	rules := map[iptables.Protocol][][]string{}
+	for _, proto := range iptablesProtocols {
+		rules[proto] = [][]string{
+			append([]string{"-o", "lo", "-j", "RETURN"}, comment("White Box VPN kill switch")...),
+			append([]string{"-m", "mark", "--mark", strconv.Itoa(APP_BYPASS_MARK), "-j", "RETURN"}, comment("White Box VPN kill switch")...),
+		}
+	}
+	for _, spec := range specs {
+		rule := func(args ...string) []string {
+			return append(args, comment(fmt.Sprintf("White Box VPN kill switch for %s", spec.Device))...)
+		}
+		for _, proto := range iptablesProtocols {
+			rules[proto] = append(rules[proto],
+				rule("-o", spec.Device, "-j", "RETURN"),
+				rule("-m", "mark", "--mark", strconv.Itoa(spec.FirewallMark), "-j", "RETURN"),
+			)
+		}
+		rules[iptables.ProtocolIPv4] = append(rules[iptables.ProtocolIPv4],
+			rule("-d", spec.ServerAddress, "-p", "udp", "--dport", strconv.Itoa(spec.ServerPort), "-j", "RETURN"),
+		)
+
+		bypass, err := parsePrefixes(spec.Bypass)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range bypass {
+			proto := iptables.ProtocolIPv4
+			if prefix.Addr().Is6() {
+				proto = iptables.ProtocolIPv6
+			}
+			rules[proto] = append(rules[proto], rule("-d", prefix.String(), "-j", "RETURN"))
+		}
+	}
+
+	for _, proto := range iptablesProtocols {
+		rules[proto] = append(rules[proto], append([]string{"-j", "DROP"}, comment("White Box VPN kill switch")...))
+	}
+	return rules, nil
+}
+
+// enableKillSwitch replaces the kill switch chain and hooks it into OUTPUT,
+// for both IPv4 and IPv6.
+func (f *iptablesFirewall) enableKillSwitch(specs []*killSwitchSpec) error {
+	chains, err := f.killSwitchRules(specs)
+	if err != nil {
+		return err
+	}
+	for proto, rules := range chains {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return newError(types.ErrInternal, "error creating new iptables", err)
+		}
+		err = replaceChain(ipt, "filter", "OUTPUT", KILL_SWITCH_CHAIN, rules)
+		if err != nil {
+			return newError(types.ErrInternal, "error enabling kill switch", err)
+		}
+	}
+	return nil
+}
+
+// disableKillSwitch unhooks and deletes the kill switch chain.
+func (f *iptablesFirewall) disableKillSwitch() error {
+	for _, proto := range iptablesProtocols {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return newError(types.ErrInternal, "error creating new iptables", err)
+		}
+		err = deleteChain(ipt, "filter", "OUTPUT", KILL_SWITCH_CHAIN)
+		if err != nil {
+			return newError(types.ErrInternal, "error disabling kill switch", err)
+		}
+	}
+	return nil
+}
+
+// markApps fills the application chain of the mangle table, where marking
+// makes the kernel route packets again, and hooks it into OUTPUT.
+func (f *iptablesFirewall) markApps(spec *appMarkSpec) error {
+	marks := map[string]int{
+		appPolicyTunnel: spec.TunnelMark,
+		appPolicyBypass: spec.BypassMark,
+	}
+	for _, proto := range iptablesProtocols {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return newError(types.ErrInternal, "error creating new iptables", err)
+		}
+
+		var rules [][]string
+		for _, policy := range []string{appPolicyTunnel, appPolicyBypass} {
+			rules = append(rules, []string{
+				"-m", "cgroup", "--path", appCgroup(policy),
+				"-j", "MARK", "--set-mark", strconv.Itoa(marks[policy]),
+				"-m", "comment", "--comment", fmt.Sprintf("White Box VPN %s applications", policy),
+			})
+		}
+		err = replaceChain(ipt, "mangle", "OUTPUT", APP_MARK_CHAIN, rules)
+		if err != nil {
+			return newError(types.ErrInternal, "error enabling application marking", err)
+		}
+	}
+	return nil
+}
+
+// masqueradeApps fills the application chain of the nat table. Marked
+// traffic had its source address picked before the mark rerouted it, so it
+// takes the address of the interface it leaves through instead: tunneled
+// application traffic when it leaves through a tunnel, bypassing traffic
+// when it leaves through any other interface.
+func (f *iptablesFirewall) masqueradeApps(spec *appMarkSpec) error {
+	tunnels := DEVICE_PREFIX + "+"
+	comment := func(policy string) []string {
+		return []string{"-m", "comment", "--comment", fmt.Sprintf("White Box VPN %s applications", policy)}
+	}
+	rules := [][]string{
+		{"-o", "lo", "-j", "RETURN"},
+		append([]string{"-o", tunnels, "-m", "mark", "--mark", strconv.Itoa(spec.TunnelMark), "-j", "MASQUERADE"}, comment(appPolicyTunnel)...),
+		append([]string{"!", "-o", tunnels, "-m", "mark", "--mark", strconv.Itoa(spec.BypassMark), "-j", "MASQUERADE"}, comment(appPolicyBypass)...),
+	}
+	for _, proto := range iptablesProtocols {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return newError(types.ErrInternal, "error creating new iptables", err)
+		}
+		err = replaceChain(ipt, "nat", "POSTROUTING", APP_MARK_CHAIN, rules)
+		if err != nil {
+			return newError(types.ErrInternal, "error enabling application masquerading", err)
+		}
+	}
+	return nil
+}
+
+// unmarkApps unhooks and deletes the application chains.
+func (f *iptablesFirewall) unmarkApps() error {
+	for _, proto := range iptablesProtocols {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return newError(types.ErrInternal, "error creating new iptables", err)
+		}
+
+		err = deleteChain(ipt, "mangle", "OUTPUT", APP_MARK_CHAIN)
+		if err == nil {
+			err = deleteChain(ipt, "nat", "POSTROUTING", APP_MARK_CHAIN)
+		}
+		if err != nil {
+			return newError(types.ErrInternal, "error disabling application marking", err)
+		}
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) clear() error {
+	err := f.disableKillSwitch()
+	if err != nil {
+		return err
+	}
+	return f.unmarkApps()
+}
+
+// replaceChain fills a new chain with the rules and hooks it into the
+// built-in chain hook in front of the current chain, which is then unhooked
+// and deleted, so that packets never pass a chain that is only partly
+// filled. The new chain then takes over the name.
+func replaceChain(ipt *iptables.IPTables, table string, hook string, chain string, rules [][]string) error {
+	newChain := chain + NEW_CHAIN_SUFFIX
+	err := ipt.ClearChain(table, newChain)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		err = ipt.Append(table, newChain, rule...)
+		if err != nil {
+			return err
+		}
+	}
+
+	exists, err := ipt.Exists(table, hook, "-j", newChain)
+	if err == nil && !exists {
+		err = ipt.Insert(table, hook, 1, "-j", newChain)
+	}
+	if err != nil {
+		return err
+	}
+	err = unhookChain(ipt, table, hook, chain)
+	if err != nil {
+		return err
+	}
+	return ipt.RenameChain(table, newChain, chain)
+}
+
+// deleteChain unhooks and deletes the chain, along with a new one that a
+// replacement left behind.
+func deleteChain(ipt *iptables.IPTables, table string, hook string, chain string) error {
+	err := unhookChain(ipt, table, hook, chain+NEW_CHAIN_SUFFIX)
+	if err != nil {
+		return err
+	}
+	return unhookChain(ipt, table, hook, chain)
+}
+
+// unhookChain removes the chain's jump from hook and deletes it, if it
+// exists.
+func unhookChain(ipt *iptables.IPTables, table string, hook string, chain string) error {
+	exists, err := ipt.ChainExists(table, chain)
+	if err != nil || !exists {
+		return err
+	}
+	err = ipt.DeleteIfExists(table, hook, "-j", chain)
+	if err != nil {
+		return err
+	}
+	return ipt.ClearAndDeleteChain(table, chain)
+}
@@ -0,0 +1,365 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+const NFTABLES_TABLE = "whitebox"
+const NFTABLES_KILL_SWITCH_CHAIN = "killswitch"
+const NFTABLES_APP_MARK_CHAIN = "apps"
+const NFTABLES_APP_NAT_CHAIN = "appsnat"
+
+// The cgroup match of xtables (revision 1), which nftables has no native
+// expression for in the library
+const XT_CGROUP_REVISION = 1
+const XT_CGROUP_PATH_LEN = 4096
+const XT_CGROUP_INFO_SIZE = 4112
+
+// nftablesFirewall manages the daemon's rules over netlink, in an inet table
+// of its own. Every change is sent as a single batch, so rules are replaced
+// atomically and removing the table removes everything at once.
+type nftablesFirewall struct{}
+
+var nftablesTable = &nftables.Table{
+	Name:   NFTABLES_TABLE,
+	Family: nftables.TableFamilyINet,
+}
+
+func (f *nftablesFirewall) name() string {
+	return "nftables"
+}
+
+func (f *nftablesFirewall) available() bool {
+	c, err := nftables.New()
+	if err != nil {
+		return false
+	}
+	_, err = c.ListTablesOfFamily(nftables.TableFamilyINet)
+	return err == nil
+}
+
+// enableKillSwitch replaces the kill switch chain in one batch.
+func (f *nftablesFirewall) enableKillSwitch(specs []*killSwitchSpec) error {
+	c, err := nftables.New()
+	if err != nil {
+		return newError(types.ErrInternal, "error opening nftables connection", err)
+	}
+
+	table := c.AddTable(nftablesTable)
+	policy := nftables.ChainPolicyAccept
+	chain := &nftables.Chain{
+		Name:     NFTABLES_KILL_SWITCH_CHAIN,
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	}
+
+	// Adding the chain before deleting it makes sure there is one to
+	// delete, the chain is then built again from scratch
+	c.AddChain(chain)
+	c.DelChain(chain)
+	c.AddChain(chain)
+
+	accept := &expr.Verdict{Kind: expr.VerdictAccept}
+	rules := [][]expr.Any{
+		append(nftMatchOutputInterface("lo"), accept),
+		append(nftMatchMark(APP_BYPASS_MARK), accept),
+	}
+	for _, spec := range specs {
+		rules = append(rules,
+			append(nftMatchOutputInterface(spec.Device), accept),
+			append(nftMatchMark(spec.FirewallMark), accept),
+		)
+		serverIp := net.ParseIP(spec.ServerAddress).To4()
+		if serverIp != nil {
+			rules = append(rules, append(nftMatchUdpDestination(serverIp, spec.ServerPort), accept))
+		}
+
+		bypass, err := parsePrefixes(spec.Bypass)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range bypass {
+			rules = append(rules, append(nftMatchDestination(prefix), accept))
+		}
+	}
+	rules = append(rules, []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}})
+
+	for _, exprs := range rules {
+		c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return newError(types.ErrInternal, "error enabling kill switch", err)
+	}
+	return nil
+}
+
+// disableKillSwitch deletes the kill switch chain, and the table with it
+// when the application chain is gone as well.
+func (f *nftablesFirewall) disableKillSwitch() error {
+	return f.deleteChains([]string{NFTABLES_KILL_SWITCH_CHAIN}, "error disabling kill switch")
+}
+
+// markApps replaces the application chain in one batch. It is a route
+// chain, so the kernel routes packets again once they are marked.
+func (f *nftablesFirewall) markApps(spec *appMarkSpec) error {
+	c, err := nftables.New()
+	if err != nil {
+		return newError(types.ErrInternal, "error opening nftables connection", err)
+	}
+
+	table := c.AddTable(nftablesTable)
+	chain := &nftables.Chain{
+		Name:     NFTABLES_APP_MARK_CHAIN,
+		Table:    table,
+		Type:     nftables.ChainTypeRoute,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityMangle,
+	}
+	c.AddChain(chain)
+	c.DelChain(chain)
+	c.AddChain(chain)
+
+	marks := map[string]int{
+		appPolicyTunnel: spec.TunnelMark,
+		appPolicyBypass: spec.BypassMark,
+	}
+	for _, policy := range []string{appPolicyTunnel, appPolicyBypass} {
+		exprs := append(nftMatchCgroup(appCgroup(policy)), nftSetMark(marks[policy])...)
+		c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return newError(types.ErrInternal, "error enabling application marking", err)
+	}
+	return nil
+}
+
+// masqueradeApps replaces the application nat chain in one batch. Marked
+// traffic had its source address picked before the mark rerouted it, so it
+// takes the address of the interface it leaves through instead: tunneled
+// application traffic when it leaves through a tunnel, bypassing traffic
+// when it leaves through any other interface.
+func (f *nftablesFirewall) masqueradeApps(spec *appMarkSpec) error {
+	c, err := nftables.New()
+	if err != nil {
+		return newError(types.ErrInternal, "error opening nftables connection", err)
+	}
+
+	table := c.AddTable(nftablesTable)
+	chain := &nftables.Chain{
+		Name:     NFTABLES_APP_NAT_CHAIN,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	}
+	c.AddChain(chain)
+	c.DelChain(chain)
+	c.AddChain(chain)
+
+	rules := [][]expr.Any{
+		append(nftMatchOutputInterface("lo"), &expr.Verdict{Kind: expr.VerdictReturn}),
+		append(append(nftMatchMark(spec.TunnelMark), nftMatchOutputInterfacePrefix(DEVICE_PREFIX, expr.CmpOpEq)...), &expr.Masq{}),
+		append(append(nftMatchMark(spec.BypassMark), nftMatchOutputInterfacePrefix(DEVICE_PREFIX, expr.CmpOpNeq)...), &expr.Masq{}),
+	}
+	for _, exprs := range rules {
+		c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return newError(types.ErrInternal, "error enabling application masquerading", err)
+	}
+	return nil
+}
+
+// unmarkApps deletes the application chains, and the table with them when
+// the kill switch chain is gone as well.
+func (f *nftablesFirewall) unmarkApps() error {
+	return f.deleteChains([]string{NFTABLES_APP_MARK_CHAIN, NFTABLES_APP_NAT_CHAIN}, "error disabling application marking")
+}
+
+// deleteChains deletes the named chains of the daemon's table that are
+// there. The table goes as well once it has no chains left, so that nothing
+// of the daemon stays behind.
+func (f *nftablesFirewall) deleteChains(names []string, errorMessage string) error {
+	c, err := nftables.New()
+	if err != nil {
+		return newError(types.ErrInternal, "error opening nftables connection", err)
+	}
+
+	chains, err := c.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return newError(types.ErrInternal, "error listing chains", err)
+	}
+	var table *nftables.Table
+	var deleted []*nftables.Chain
+	others := 0
+	for _, chain := range chains {
+		if chain.Table.Name != NFTABLES_TABLE {
+			continue
+		}
+		table = chain.Table
+		if containsString(names, chain.Name) {
+			deleted = append(deleted, chain)
+		} else {
+			others++
+		}
+	}
+	if table != nil && others == 0 {
+		c.DelTable(table)
+	} else {
+		for _, chain := range deleted {
+			c.FlushChain(chain)
+			c.DelChain(chain)
+		}
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return newError(types.ErrInternal, errorMessage, err)
+	}
+	return nil
+}
+
+// clear deletes the daemon's table with everything in it.
+func (f *nftablesFirewall) clear() error {
+	c, err := nftables.New()
+	if err != nil {
+		return newError(types.ErrInternal, "error opening nftables connection", err)
+	}
+
+	tables, err := c.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return newError(types.ErrInternal, "error listing tables", err)
+	}
+	for _, table := range tables {
+		if table.Name == NFTABLES_TABLE {
+			c.DelTable(table)
+		}
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return newError(types.ErrInternal, "error deleting table", err)
+	}
+	return nil
+}
+
+// nftMatchOutputInterface matches packets leaving through the named
+// interface.
+func nftMatchOutputInterface(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftInterfaceName(name)},
+	}
+}
+
+// nftMatchOutputInterfacePrefix matches packets leaving, or with CmpOpNeq
+// not leaving, through an interface whose name starts with prefix.
+func nftMatchOutputInterfacePrefix(prefix string, op expr.CmpOp) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: []byte(prefix)},
+	}
+}
+
+// nftMatchMark matches packets carrying the firewall mark.
+func nftMatchMark(mark int) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(mark))},
+	}
+}
+
+// nftMatchUdpDestination matches IPv4 UDP packets sent to the address and
+// port.
+func nftMatchUdpDestination(ip net.IP, port int) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(port))},
+	}
+}
+
+// nftMatchDestination matches packets sent to the range.
+func nftMatchDestination(prefix netip.Prefix) []expr.Any {
+	proto, offset := byte(unix.NFPROTO_IPV4), uint32(16)
+	if prefix.Addr().Is6() {
+		proto, offset = unix.NFPROTO_IPV6, 24
+	}
+	addr := prefix.Addr().AsSlice()
+	mask := net.CIDRMask(prefix.Bits(), len(addr)*8)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(addr)), Mask: mask, Xor: make([]byte, len(addr))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+	}
+}
+
+// nftMatchCgroup matches packets of sockets in the cgroup v2 group at path,
+// relative to the root of the hierarchy.
+func nftMatchCgroup(path string) []expr.Any {
+	// struct xt_cgroup_info_v1: has_path, has_classid, invert_path,
+	// invert_classid, path, classid and room for the kernel's pointer
+	info := make(xt.Unknown, XT_CGROUP_INFO_SIZE)
+	info[0] = 1
+	copy(info[4:4+XT_CGROUP_PATH_LEN-1], path)
+	return []expr.Any{
+		&expr.Match{Name: "cgroup", Rev: XT_CGROUP_REVISION, Info: &info},
+	}
+}
+
+// nftSetMark sets the firewall mark of packets.
+func nftSetMark(mark int) []expr.Any {
+	return []expr.Any{
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(mark))},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	}
+}
+
+// nftInterfaceName pads an interface name the way the kernel compares them.
+func nftInterfaceName(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
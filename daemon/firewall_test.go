@@ -0,0 +1,501 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// availableFirewalls returns the backends that work in the test's network
+// namespace, skipping the test when there are none.
+func availableFirewalls(t *testing.T) []firewall {
+	var available []firewall
+	for _, backend := range firewalls {
+		if backend.available() {
+			available = append(available, backend)
+		}
+	}
+	if len(available) == 0 {
+		t.Skip("no firewall backend is available")
+	}
+	return available
+}
+
+// mustNetlink fails the test on the first error of a list of netlink
+// calls.
+func mustNetlink(t *testing.T, errs ...error) {
+	t.Helper()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func addAddress(t *testing.T, device string, address string) {
+	t.Helper()
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := netlink.ParseAddr(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustNetlink(t, netlink.AddrAdd(link, addr), netlink.LinkSetUp(link))
+}
+
+// markTestTraffic marks UDP traffic to each port with its mark in a route
+// chain, the way the application chain marks the traffic of a cgroup.
+func markTestTraffic(t *testing.T, marks map[uint16]int) {
+	c, err := nftables.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := c.AddTable(&nftables.Table{Name: "test", Family: nftables.TableFamilyINet})
+	chain := c.AddChain(&nftables.Chain{
+		Name:     "mark",
+		Table:    table,
+		Type:     nftables.ChainTypeRoute,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityMangle,
+	})
+	for port, mark := range marks {
+		exprs := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+		}
+		c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: append(exprs, nftSetMark(mark)...)})
+	}
+	err = c.Flush()
+	if err != nil {
+		t.Skip("unable to mark traffic with nftables: ", err)
+	}
+}
+
+// TestMasqueradeApps sends marked traffic from a host with a LAN link and a
+// tunnel link to a remote host behind both, and checks the address each
+// packet arrives from. The tunnel's routes are set up the way they are for
+// a tunnel just for applications and for a tunnel that takes everything.
+func TestMasqueradeApps(t *testing.T) {
+	const table = 100
+	const lanAddress = "192.168.1.2"
+	const tunnelAddress = "10.64.0.2"
+	enterTestNamespace(t, "wb0")
+	host, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	remote, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	mustNetlink(t, netns.Set(host))
+
+	// The far ends of the LAN and tunnel links are the remote host's
+	lan := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "lan0"}, PeerName: "lan0p"}
+	mustNetlink(t, netlink.LinkAdd(lan))
+	for _, name := range []string{"lan0p", "wb0p"} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustNetlink(t, netlink.LinkSetNsFd(link, int(remote)))
+	}
+
+	addAddress(t, "lan0", lanAddress+"/24")
+	addAddress(t, "wb0", tunnelAddress+"/32")
+	wb0, err := netlink.LinkByName("wb0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustNetlink(t,
+		netlink.RouteAdd(&netlink.Route{Gw: net.ParseIP("192.168.1.1")}),
+		netlink.RouteAdd(&netlink.Route{Dst: &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			LinkIndex: wb0.Attrs().Index, Table: table, Scope: unix.RT_SCOPE_LINK}),
+	)
+
+	// 198.51.100.1 is only reached through the tunnel by tunneled
+	// applications, 198.51.100.2 is reached through the tunnel unless the
+	// application bypasses it
+	var undo undoLog
+	rules := append(bypassRules(),
+		ruleSpec{Priority: RULE_PRIORITY_TUNNELS, Src: ALL_NETWORK_RANGE, Table: table, Mark: APP_TUNNEL_MARK, SuppressPrefixlen: -1})
+	err = configureIpRules(&undo, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	everything := netlink.NewRule()
+	everything.Priority = RULE_PRIORITY_TUNNELS + 1
+	everything.Dst = &net.IPNet{IP: net.ParseIP("198.51.100.2"), Mask: net.CIDRMask(32, 32)}
+	everything.Table = table
+	mustNetlink(t, netlink.RuleAdd(everything))
+	markTestTraffic(t, map[uint16]int{9000: APP_TUNNEL_MARK, 9001: APP_BYPASS_MARK})
+
+	mustNetlink(t, netns.Set(remote))
+	addAddress(t, "lo", "198.51.100.1/32")
+	addAddress(t, "lo", "198.51.100.2/32")
+	addAddress(t, "lan0p", "192.168.1.1/24")
+	addAddress(t, "wb0p", "10.64.0.1/32")
+	wb0p, err := netlink.LinkByName("wb0p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustNetlink(t, netlink.RouteAdd(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP(tunnelAddress), Mask: net.CIDRMask(32, 32)},
+		LinkIndex: wb0p.Attrs().Index, Scope: unix.RT_SCOPE_LINK}))
+	listeners := map[string]net.PacketConn{}
+	for _, address := range []string{"198.51.100.1:9000", "198.51.100.2:9001"} {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		listeners[address] = conn
+	}
+	mustNetlink(t, netns.Set(host))
+
+	tests := []struct {
+		name    string
+		address string
+		want    string
+	}{
+		{"tunneled application", "198.51.100.1:9000", tunnelAddress},
+		{"bypassing application", "198.51.100.2:9001", lanAddress},
+	}
+	spec := &appMarkSpec{TunnelMark: APP_TUNNEL_MARK, BypassMark: APP_BYPASS_MARK}
+	for _, backend := range availableFirewalls(t) {
+		err = backend.masqueradeApps(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", backend.name(), err)
+		}
+		for _, test := range tests {
+			addr, err := net.ResolveUDPAddr("udp", test.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := net.DialUDP("udp", nil, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = conn.Write([]byte(test.name))
+			conn.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			listener := listeners[test.address]
+			listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+			buf := make([]byte, 64)
+			_, from, err := listener.ReadFrom(buf)
+			if err != nil {
+				t.Errorf("%s: %s: nothing arrived: %v", backend.name(), test.name, err)
+				continue
+			}
+			source := from.(*net.UDPAddr).IP.String()
+			if source != test.want {
+				t.Errorf("%s: %s arrived from %s, want %s", backend.name(), test.name, source, test.want)
+			}
+		}
+		err = backend.unmarkApps()
+		if err != nil {
+			t.Fatalf("%s: %v", backend.name(), err)
+		}
+	}
+}
+
+// installedRules lists the daemon's tables and the chains of its that
+// packets pass through. A chain that is taking over from another counts
+// under the name it takes over.
+func installedRules(t *testing.T, backend firewall) []string {
+	var names []string
+	switch backend.(type) {
+	case *nftablesFirewall:
+		c, err := nftables.New()
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		tables, err := c.ListTablesOfFamily(nftables.TableFamilyINet)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		for _, table := range tables {
+			if table.Name == NFTABLES_TABLE {
+				names = append(names, "table "+table.Name)
+			}
+		}
+		chains, err := c.ListChainsOfTableFamily(nftables.TableFamilyINet)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		for _, chain := range chains {
+			if chain.Table.Name == NFTABLES_TABLE {
+				names = append(names, "chain "+chain.Name)
+			}
+		}
+	case *iptablesFirewall:
+		hooks := [][2]string{{"filter", "OUTPUT"}, {"mangle", "OUTPUT"}, {"nat", "POSTROUTING"}}
+		for _, proto := range iptablesProtocols {
+			ipt, err := iptables.NewWithProtocol(proto)
+			if err != nil {
+				t.Error(err)
+				return nil
+			}
+			for _, hook := range hooks {
+				rules, err := ipt.List(hook[0], hook[1])
+				if err != nil {
+					t.Error(err)
+					return nil
+				}
+				for _, rule := range rules {
+					fields := strings.Fields(rule)
+					if len(fields) == 4 && fields[2] == "-j" && strings.HasPrefix(fields[3], "WHITEBOX-") {
+						chain := strings.TrimSuffix(fields[3], NEW_CHAIN_SUFFIX)
+						names = append(names, fmt.Sprintf("%d %s %s", proto, hook[0], chain))
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// passesFirewall reports whether a UDP packet to the address makes it
+// through the firewall. Packets the firewall drops fail to send.
+func passesFirewall(t *testing.T, address string) bool {
+	conn, err := net.Dial("udp4", address)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("kill switch"))
+	if err != nil && !errors.Is(err, syscall.EPERM) {
+		t.Error(err)
+	}
+	return err == nil
+}
+
+// firewallTestLinks adds a LAN link and the links of two tunnels, with
+// their far ends up, so that packets are routed out of every one of them.
+func firewallTestLinks(t *testing.T) {
+	enterTestNamespace(t, "wb0")
+	for _, name := range []string{"wb1", "lan0"} {
+		mustNetlink(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}))
+	}
+	for _, name := range []string{"wb0p", "wb1p", "lan0p"} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustNetlink(t, netlink.LinkSetUp(link))
+	}
+	addAddress(t, "lan0", "192.168.1.2/24")
+	addAddress(t, "wb0", "10.64.0.2/24")
+	addAddress(t, "wb1", "10.65.0.2/24")
+}
+
+// firewallTestSpecs returns the kill switches of the tunnels on wb0 and
+// wb1, and the application marks.
+func firewallTestSpecs() (*killSwitchSpec, *killSwitchSpec, *appMarkSpec) {
+	wb0 := &killSwitchSpec{Device: "wb0", ServerAddress: "192.168.1.1", ServerPort: 51820, FirewallMark: 0x57420100}
+	wb1 := &killSwitchSpec{Device: "wb1", ServerAddress: "192.168.1.1", ServerPort: 51821, FirewallMark: 0x57420101}
+	apps := &appMarkSpec{TunnelMark: APP_TUNNEL_MARK, BypassMark: APP_BYPASS_MARK}
+	return wb0, wb1, apps
+}
+
+// installApps marks and masquerades application traffic, and reports
+// whether the marking took. Marking needs the cgroup match, which not every
+// kernel has, masquerading is installed either way.
+func installApps(t *testing.T, backend firewall, spec *appMarkSpec) bool {
+	marked := backend.markApps(spec) == nil
+	err := backend.masqueradeApps(spec)
+	if err != nil {
+		t.Fatalf("%s: %v", backend.name(), err)
+	}
+	return marked
+}
+
+// TestFirewallReplace replaces the kill switch and the application rules
+// over and over while packets are sent past the kill switch and the chains
+// are listed, and checks that neither ever finds the rules missing.
+func TestFirewallReplace(t *testing.T) {
+	firewallTestLinks(t)
+	wb0, wb1, apps := firewallTestSpecs()
+	for _, backend := range availableFirewalls(t) {
+		err := backend.enableKillSwitch([]*killSwitchSpec{wb0})
+		if err != nil {
+			t.Fatalf("%s: %v", backend.name(), err)
+		}
+		marked := installApps(t, backend, apps)
+		installed := installedRules(t, backend)
+		if !passesFirewall(t, "10.64.0.1:9") || passesFirewall(t, "192.168.1.1:9") {
+			t.Fatalf("%s: kill switch is not in place", backend.name())
+		}
+
+		var leaked, missing int
+		stop := make(chan struct{})
+		sent := goInTestNamespace(t, func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if passesFirewall(t, "192.168.1.1:9") {
+					leaked++
+				}
+			}
+		})
+		listed := goInTestNamespace(t, func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if !reflect.DeepEqual(installedRules(t, backend), installed) {
+					missing++
+				}
+			}
+		})
+
+		for i := 0; i < 20; i++ {
+			specs := []*killSwitchSpec{wb0}
+			if i%2 == 0 {
+				specs = append(specs, wb1)
+			}
+			err = backend.enableKillSwitch(specs)
+			if err != nil {
+				t.Fatalf("%s: %v", backend.name(), err)
+			}
+			if installApps(t, backend, apps) != marked {
+				t.Fatalf("%s: application marking came and went", backend.name())
+			}
+		}
+		close(stop)
+		<-sent
+		<-listed
+
+		if leaked > 0 {
+			t.Errorf("%s: %d packets got past the kill switch while it was replaced", backend.name(), leaked)
+		}
+		if missing > 0 {
+			t.Errorf("%s: rules were missing %d times while they were replaced", backend.name(), missing)
+		}
+		err = backend.clear()
+		if err != nil {
+			t.Fatalf("%s: %v", backend.name(), err)
+		}
+	}
+}
+
+// TestFirewallTeardown tears down one tunnel after the other, the last
+// with the application marks, and checks that the rules of the last tunnel
+// stay in place until it goes as well.
+func TestFirewallTeardown(t *testing.T) {
+	firewallTestLinks(t)
+	wb0, wb1, apps := firewallTestSpecs()
+	selected := fw
+	defer func() {
+		fw = selected
+		tunnels = map[string]*tunnelState{}
+	}()
+
+	tests := []struct {
+		name       string
+		killSwitch bool
+	}{
+		{"kill switch on both tunnels", true},
+		{"kill switch on the first tunnel", false},
+	}
+	for _, backend := range availableFirewalls(t) {
+		fw = backend
+		for _, test := range tests {
+			first := &tunnelState{Device: "wb0"}
+			last := &tunnelState{Device: "wb1"}
+			tunnels = map[string]*tunnelState{first.Device: first, last.Device: last}
+			if test.killSwitch {
+				err := enableKillSwitch(wb1)
+				if err != nil {
+					t.Fatalf("%s: %v", backend.name(), err)
+				}
+				last.Undo.record(action{Kind: actionKillSwitch, KillSwitch: wb1})
+			}
+			installApps(t, backend, apps)
+			last.Undo.record(action{Kind: actionAppMarks, AppMarks: apps})
+			lastOnly := installedRules(t, backend)
+			err := enableKillSwitch(wb0)
+			if err != nil {
+				t.Fatalf("%s: %v", backend.name(), err)
+			}
+			first.Undo.record(action{Kind: actionKillSwitch, KillSwitch: wb0})
+
+			err = first.Undo.rollback()
+			if err != nil {
+				t.Fatalf("%s: %s: %v", backend.name(), test.name, err)
+			}
+			delete(tunnels, first.Device)
+			if got := installedRules(t, backend); !reflect.DeepEqual(got, lastOnly) {
+				t.Errorf("%s: %s: %v after the first tunnel went, want %v", backend.name(), test.name, got, lastOnly)
+			}
+			if passesFirewall(t, "10.64.0.1:9") != !test.killSwitch || passesFirewall(t, "192.168.1.1:9") != !test.killSwitch {
+				t.Errorf("%s: %s: kill switch after the first tunnel went does not follow the last", backend.name(), test.name)
+			}
+			if !passesFirewall(t, "10.65.0.1:9") {
+				t.Errorf("%s: %s: kill switch blocks the last tunnel", backend.name(), test.name)
+			}
+
+			err = last.Undo.rollback()
+			if err != nil {
+				t.Fatalf("%s: %s: %v", backend.name(), test.name, err)
+			}
+			delete(tunnels, last.Device)
+			if got := installedRules(t, backend); len(got) > 0 {
+				t.Errorf("%s: %s: %v left after the last tunnel went", backend.name(), test.name, got)
+			}
+			if !passesFirewall(t, "192.168.1.1:9") {
+				t.Errorf("%s: %s: kill switch still in place after the last tunnel went", backend.name(), test.name)
+			}
+		}
+	}
+}
@@ -4,9 +4,13 @@ go 1.19
 
 require (
 	github.com/coreos/go-iptables v0.6.0
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/google/nftables v0.0.0-20220808154552-2eca00135732
+	github.com/miekg/dns v1.1.50
 	github.com/vishvananda/netlink v1.2.1-beta.2
+	github.com/vishvananda/netns v0.0.0-20220913150850-18c4f4234207
 	github.com/whiteboxvpn/cli/types v0.0.0-20230520164024-d9a8a37a8439
-	golang.org/x/sys v0.0.0-20221013171732-95e765b1cc43
+	golang.org/x/sys v0.13.0
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20220916014741-473347a5e6e3
 )
 
@@ -16,9 +20,10 @@ require (
 	github.com/mdlayher/genetlink v1.2.0 // indirect
 	github.com/mdlayher/netlink v1.6.0 // indirect
 	github.com/mdlayher/socket v0.2.3 // indirect
-	github.com/vishvananda/netns v0.0.0-20220913150850-18c4f4234207 // indirect
-	golang.org/x/crypto v0.0.0-20220411220226-7b82a4e95df4 // indirect
-	golang.org/x/net v0.0.0-20220418201149-a630d4f3e7a2 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
+	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.zx2c4.com/wireguard v0.0.0-20220407013110-ef5c587f782d // indirect
 )
+
+replace github.com/whiteboxvpn/cli/types => ../types
@@ -0,0 +1,86 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+// killSwitchSpec describes the kill switch of a tunnel. While it is enabled
+// all traffic leaving the machine is dropped, except loopback traffic,
+// traffic through the tunnel, the tunnel's own packets to the server and
+// traffic to the ranges excluded from the tunnel.
+type killSwitchSpec struct {
+	Firewall      string   `json:"firewall"`
+	Device        string   `json:"device"`
+	ServerAddress string   `json:"serverAddress"`
+	ServerPort    int      `json:"serverPort"`
+	FirewallMark  int      `json:"firewallMark"`
+	Bypass        []string `json:"bypass,omitempty"`
+}
+
+// enableKillSwitch installs the kill switch with the firewall backend in
+// use, and notes the backend in spec. There is one kill switch for all
+// tunnels, which lets the traffic of every tunnel with a kill switch
+// through.
+func enableKillSwitch(spec *killSwitchSpec) error {
+	if fw == nil {
+		return noFirewallError()
+	}
+	spec.Firewall = fw.name()
+	return fw.enableKillSwitch(append(otherKillSwitches(spec.Device), spec))
+}
+
+// disableKillSwitch takes the tunnel described by spec out of the kill
+// switch, and removes the kill switch once no other tunnel has one. A nil
+// spec removes the kill switch with the backend in use. Without a firewall
+// backend there is nothing to remove.
+func disableKillSwitch(spec *killSwitchSpec) error {
+	backend := fw
+	if spec != nil && spec.Firewall != "" {
+		for _, f := range firewalls {
+			if f.name() == spec.Firewall && f.available() {
+				backend = f
+			}
+		}
+	}
+	if backend == nil {
+		return nil
+	}
+	if spec != nil {
+		others := otherKillSwitches(spec.Device)
+		if len(others) > 0 {
+			return backend.enableKillSwitch(others)
+		}
+	}
+	return backend.disableKillSwitch()
+}
+
+// otherKillSwitches returns the kill switches of the tunnels other than the
+// one on device.
+func otherKillSwitches(device string) []*killSwitchSpec {
+	var specs []*killSwitchSpec
+	for _, state := range sortedTunnels() {
+		if state.Device == device {
+			continue
+		}
+		for _, a := range state.Undo.Actions {
+			if a.Kind == actionKillSwitch {
+				specs = append(specs, a.KillSwitch)
+			}
+		}
+	}
+	return specs
+}
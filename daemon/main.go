@@ -19,282 +19,787 @@ White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"net/rpc"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/whiteboxvpn/cli/types"
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-type Listener int
-
-type Reply struct {
-	Data string
-}
-
-type VPNDisconnectData struct {
-	ServerAddress string
-	ServerPort    int
+// Listener serves the RPC API. Every connection on the Unix socket gets a
+// Listener of its own that knows the process on the other end, the
+// standard streams it passed, and the command it runs in the tunnel's
+// namespace, if any.
+type Listener struct {
+	peer    *unix.Ucred
+	lock    sync.Mutex
+	streams []*os.File
+	command *os.Process
 }
 
-var deviceName = "wg0"
-
+// Tunnels use the wireguard links wb0 to wbN. Links named with the
+// DEVICE_PREFIX are considered to belong to the daemon.
+const DEVICE_PREFIX = "wb"
 const ALL_NETWORK_RANGE = "0.0.0.0/0"
-
-func (l *Listener) VPNDisconnect(data VPNDisconnectData, reply *Reply) error {
-
-	link, err := netlink.LinkByName(deviceName)
-	if err != nil {
-		log.Fatal("error finding link: ", err)
+const ALL_NETWORK_RANGE6 = "::/0"
+
+// The daemon's IP rules get priorities from this band, which is how they are
+// told apart from rules added by anything else. The first
+// RULE_PRIORITY_RESERVED priorities are for rules that go in front of every
+// tunnel's. The tunnel on wbN uses RULE_PRIORITY_TUNNELS+2N and the
+// priority after it when it only takes some traffic, and the same
+// priorities MAX_TUNNELS pairs further on when it takes everything, so
+// that tunnels for some ranges get their traffic before tunnels for all of
+// it do.
+const RULE_PRIORITY_BASE = 31000
+const RULE_PRIORITY_COUNT = 1000
+const RULE_PRIORITY_RESERVED = 10
+const RULE_PRIORITY_TUNNELS = RULE_PRIORITY_BASE + RULE_PRIORITY_RESERVED
+
+// RULE_PRIORITY_ENDPOINTS is the priority of the rules that send every
+// tunnel's own packets to its server past the other tunnels' rules.
+const RULE_PRIORITY_ENDPOINTS = RULE_PRIORITY_BASE + 1
+
+// tunnelLock serialises RPC calls that change the tunnels.
+var tunnelLock sync.Mutex
+
+func (l *Listener) VPNDisconnect(data types.VPNDisconnectData, reply *types.Reply) error {
+	tunnelLock.Lock()
+	defer tunnelLock.Unlock()
+
+	states := sortedTunnels()
+	if len(data.Name) > 0 {
+		state := findTunnel(data.Name)
+		if state == nil {
+			return logError("VPNDisconnect", newError(types.ErrNotConnected, fmt.Sprintf("no tunnel named %s is up", data.Name), nil))
+		}
+		states = []*tunnelState{state}
 	}
-
-	// Disable IP routes
-	routingNet, err := netlink.ParseIPNet(ALL_NETWORK_RANGE)
-	if err != nil {
-		log.Fatal("error parsing routing address: ", err)
+	if len(states) == 0 {
+		return logError("VPNDisconnect", newError(types.ErrNotConnected, "no tunnel is up", nil))
 	}
 
-	configureIpRules(false, routingNet, data.ServerPort)
-	configureIpRoutes(false, link.Attrs().Index, data.ServerPort, routingNet)
-
-	err = netlink.LinkDel(link)
-	if err != nil {
-		log.Fatal("error deleting link: ", err)
+	// Whatever cannot be undone stays in the state, so that disconnecting
+	// again retries it.
+	var firstErr error
+	for _, state := range states {
+		handOverAppMarks(state, sortedTunnels())
+		err := state.Undo.rollback()
+		if err != nil {
+			saveErr := saveState(state)
+			if saveErr != nil {
+				log.Print("error saving tunnel state: ", saveErr)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		dropTunnel(state)
+	}
+	if firstErr != nil {
+		return logError("VPNDisconnect", firstErr)
 	}
-
-	// Disable IPTables
-	//configureIptables(false, deviceName, data.ServerAddress)
 
 	rv := "done"
 	fmt.Printf("Receive: %v\n", rv)
-	*reply = Reply{rv}
+	*reply = types.Reply{Data: rv}
 	return nil
 }
 
-func (l *Listener) ConfigureWgInterface(configData types.ConfigData, reply *Reply) error {
+// ConfigureWgInterface brings up a tunnel. Connecting to a server that
+// already has a tunnel is refused, unless the client asks to replace a
+// tunnel, which then changes into the new one in place.
+func (l *Listener) ConfigureWgInterface(configData types.ConfigData, reply *types.Reply) error {
+	tunnelLock.Lock()
+	defer tunnelLock.Unlock()
+
+	var replaced *tunnelState
+	if len(configData.Replace) > 0 {
+		replaced = findTunnel(configData.Replace)
+		if replaced == nil {
+			return logError("ConfigureWgInterface", newError(types.ErrNotConnected, fmt.Sprintf("no tunnel named %s is up", configData.Replace), nil))
+		}
+	}
+	err := checkExclusive(configData, replaced)
+	if err != nil {
+		return logError("ConfigureWgInterface", err)
+	}
 
-	// Parse the server's wireguard public key
-	serverPublicKey, err := wgtypes.ParseKey(string(configData.ServerPublicKeyData))
+	if replaced != nil {
+		// A failed replacement leaves a tunnel that can still be torn
+		// down, so the state is saved either way
+		err = replaceTunnel(configData, replaced)
+		if err == nil {
+			replaced.setConnState(types.StateConnecting)
+			configData.Replace = ""
+			replaced.Config = configData
+		}
+		saveErr := saveState(replaced)
+		if saveErr != nil {
+			log.Print("error saving tunnel state: ", saveErr)
+		}
+		if err != nil {
+			emitEvent(types.EventError, replaced.Device, replaced.ServerName, types.ParseRPCError(err).Message)
+			return logError("ConfigureWgInterface", err)
+		}
+		fmt.Printf("Replaced configuration of device %s\n", replaced.Device)
+		*reply = types.Reply{Data: replaced.Device}
+		return nil
+	}
 
-	// Set the allowed range (which is 0.0.0.0/0)
-	_, zeroRange, err := net.ParseCIDR(ALL_NETWORK_RANGE)
+	state, err := bringUp(configData)
 	if err != nil {
-		log.Fatal(err)
+		emitEvent(types.EventError, "", configData.ServerName, types.ParseRPCError(err).Message)
+		return logError("ConfigureWgInterface", err)
 	}
-	allowIpsFromServer := []net.IPNet{*zeroRange}
 
-	serverIp := net.ParseIP(configData.ServerAddress)
-	serverPort := configData.ServerPort
-	peer := wgtypes.PeerConfig{
-		PublicKey:  serverPublicKey,
-		AllowedIPs: allowIpsFromServer,
-		Endpoint: &net.UDPAddr{
-			IP:   serverIp,
-			Port: serverPort,
-		},
+	rv := state.Device
+	fmt.Printf("Finished configuration of device %s\n", state.Device)
+	*reply = types.Reply{Data: rv}
+	return nil
+}
+
+// bringUp brings up a new tunnel and adds it to the tunnels. Every change
+// is recorded as it is made, so that a failure in any step puts the system
+// back into the state it was in before.
+func bringUp(configData types.ConfigData) (*tunnelState, error) {
+	state := &tunnelState{}
+	err := configureTunnel(configData, state)
+	if err != nil {
+		rollbackErr := state.Undo.rollback()
+		if rollbackErr != nil {
+			log.Print("error rolling back tunnel setup: ", rollbackErr)
+		}
+		return nil, err
 	}
 
-	// Parse the client wireguard private key
-	clientPrivateKey, err := wgtypes.ParseKey(configData.ClientPrivateKey)
+	tunnels[state.Device] = state
+	state.setConnState(types.StateConnecting)
+	state.Config = configData
+	err = saveState(state)
 	if err != nil {
-		log.Fatal("error parsing private key: ", err)
+		log.Print("error saving tunnel state: ", err)
 	}
+	return state, nil
+}
 
-	// Creating the network's "link" object
-	var device netlink.Link
-	existingLinks, err := netlink.LinkList()
+// configureTunnel brings up the wireguard tunnel described by configData and
+// records every change it makes in the state's undo log. The routing rules
+// that send traffic into the tunnel are only added once the device is fully
+// set up.
+func configureTunnel(configData types.ConfigData, state *tunnelState) error {
+	err := checkExclusive(configData, nil)
 	if err != nil {
-		log.Fatal("error listing links: ", err)
+		return err
 	}
-	linkExists := false
-	for _, link := range existingLinks {
-		if link.Attrs().Name == deviceName {
-			linkExists = true
-			device = link
-		}
+	err = setupTunnel(configData, state)
+	if err != nil || len(state.Namespace) > 0 {
+		return err
 	}
-	if !linkExists {
-		la := netlink.NewLinkAttrs()
-		la.Name = deviceName
-		la.MTU = 1420
-		device = &netlink.Wireguard{LinkAttrs: la}
-		err = netlink.LinkAdd(device)
-		if err != nil {
-			log.Fatal("error adding new link: ", err)
+	return activateTunnel(configData, state)
+}
+
+// checkExclusive makes sure the tunnel described by configData only asks
+// for what no other tunnel than the one it replaces has. There is one
+// tunnel to each server, and the namespace, the DNS forwarder and the
+// application mark exist only once, so only one tunnel at a time can use
+// them.
+func checkExclusive(configData types.ConfigData, replaced *tunnelState) error {
+	for _, other := range sortedTunnels() {
+		if other == replaced {
+			continue
+		}
+		if len(configData.ServerName) > 0 && other.ServerName == configData.ServerName {
+			return newError(types.ErrTunnelExists, fmt.Sprintf("tunnel %s is already connected to %s", other.Device, other.ServerName), nil)
+		}
+		if configData.Namespace && len(other.Namespace) > 0 {
+			return newError(types.ErrInvalidConfig, fmt.Sprintf("tunnel %s already uses the network namespace", other.Device), nil)
 		}
+		if len(configData.TunnelDomains) > 0 && len(other.TunnelDomains) > 0 {
+			return newError(types.ErrInvalidConfig, fmt.Sprintf("tunnel %s already tunnels domains", other.Device), nil)
+		}
+		if configData.AppsOnly && other.AppsOnly {
+			return newError(types.ErrInvalidConfig, fmt.Sprintf("tunnel %s is already just for applications", other.Device), nil)
+		}
+	}
+	return nil
+}
+
+// setupTunnel brings up the tunnel's device with its addresses, routes and
+// kill switch, but sends no traffic into it yet. A namespaced tunnel is
+// complete after this.
+func setupTunnel(configData types.ConfigData, state *tunnelState) error {
+	undo := &state.Undo
+
+	// The ranges sent through the tunnel, which are also the ranges the
+	// server is allowed to send from
+	routedNets, err := tunnelRanges(configData)
+	if err != nil {
+		return err
 	}
-	address, err := netlink.ParseAddr(configData.ClientAddress)
+	if configData.Namespace && (configData.AppsOnly || len(configData.TunnelDomains) > 0) {
+		return newError(types.ErrInvalidConfig, "a namespaced tunnel takes all traffic of its namespace", nil)
+	}
+	allowedNets, err := allowedRanges(configData, routedNets)
 	if err != nil {
-		log.Fatal("error parsing client address: ", err)
+		return err
 	}
-	err = netlink.AddrReplace(device, address)
+	peer, err := serverPeer(configData, allowedNets)
 	if err != nil {
-		log.Fatal("error setting ip address: ", err)
+		return err
 	}
-
-	// Setting the link "up"
-	err = netlink.LinkSetUp(device)
+	clientPrivateKey, err := wgtypes.ParseKey(configData.ClientPrivateKey)
 	if err != nil {
-		log.Fatal("error setting up device: ", err)
+		return newError(types.ErrInvalidKey, "error parsing private key", err)
+	}
+	clientAddresses, addresses, err := clientAddrs(configData)
+	if err != nil {
+		return err
 	}
 
-	routingNet, err := netlink.ParseIPNet(ALL_NETWORK_RANGE)
+	serverPort := configData.ServerPort
+	deviceName, err := nextDevice()
+	if err != nil {
+		return err
+	}
+	state.ServerName = configData.ServerName
+	state.Device = deviceName
+	state.ServerAddress = configData.ServerAddress
+	state.ServerPort = serverPort
+	state.ClientAddress = configData.ClientAddress
+	state.ClientAddress6 = configData.ClientAddress6
+	state.IncludeRanges = configData.IncludeRanges
+	state.ExcludeRanges = configData.ExcludeRanges
+	state.TunnelDomains = configData.TunnelDomains
+	state.AppsOnly = configData.AppsOnly
+	state.PersistentKeepalive = configData.PersistentKeepalive
+	state.Table, err = allocateTable()
+	if err != nil {
+		return err
+	}
+	state.FirewallMark = state.Table
+
+	// Creating the network's "link" object. A link that is already there
+	// belongs to somebody else, as the daemon's own are removed on startup.
+	la := netlink.NewLinkAttrs()
+	la.Name = deviceName
+	la.MTU = 1420
+	var device netlink.Link = &netlink.Wireguard{LinkAttrs: la}
+	err = netlink.LinkAdd(device)
 	if err != nil {
-		msg := fmt.Sprintf("error parsing the address %s: ", ALL_NETWORK_RANGE)
-		log.Fatal(msg, err)
+		if errors.Is(err, unix.EEXIST) {
+			msg := fmt.Sprintf("link %s already exists", deviceName)
+			return newError(types.ErrLinkExists, msg, nil)
+		}
+		return newError(types.ErrInternal, "error adding new link", err)
 	}
+	undo.record(action{Kind: actionLink, Device: deviceName})
 
-	// Configure The Network Interface route through the link
-	configureIpRules(true, routingNet, serverPort)
-	configureIpRoutes(true, device.Attrs().Index, serverPort, routingNet)
+	// Reload the link to learn the index the kernel assigned to it
+	device, err = netlink.LinkByName(deviceName)
+	if err != nil {
+		return newError(types.ErrLinkNotFound, "error finding new link", err)
+	}
 
+	// The tunnel's packets to its server must not go into another tunnel,
+	// from the first handshake on
+	err = configureIpRules(undo, endpointRules(state.FirewallMark))
+	if err != nil {
+		return err
+	}
 	// Configure device with the wireguard configuration
 	cfg := wgtypes.Config{
 		PrivateKey:   &clientPrivateKey,
 		Peers:        []wgtypes.PeerConfig{peer},
 		ReplacePeers: false,
-		FirewallMark: &serverPort,
+		FirewallMark: &state.FirewallMark,
 	}
 	c, err := wgctrl.New()
 	if err != nil {
-		log.Fatalf("Error getting new wire guard client: %v", err.Error())
+		return newError(types.ErrInternal, "error getting new wireguard client", err)
 	}
-	confDErr := c.ConfigureDevice(deviceName, cfg)
-	if confDErr != nil {
-		log.Fatalf("Error configuring device %s:\n\n\t%v", deviceName, confDErr.Error())
+	defer c.Close()
+	err = c.ConfigureDevice(deviceName, cfg)
+	if err != nil {
+		msg := fmt.Sprintf("error configuring device %s", deviceName)
+		return newError(types.ErrInternal, msg, err)
 	}
-	closeErr := c.Close()
-	if closeErr != nil {
-		log.Fatalf("Error closing wireguard client:\n\n\t%v", closeErr.Error())
+
+	// A namespaced tunnel is set up inside its namespace, and leaves the
+	// host's routing, firewall and DNS alone
+	if configData.Namespace {
+		return configureNamespace(configData, state, device, addresses, routedNets)
 	}
 
-	rv := string(configData.ServerPublicKeyData)
-	fmt.Printf("Finished configuration of device\n")
-	*reply = Reply{rv}
-	return nil
-}
+	for i, address := range addresses {
+		err = netlink.AddrReplace(device, address)
+		if err != nil {
+			return newError(types.ErrInternal, "error setting ip address", err)
+		}
+		undo.record(action{Kind: actionAddress, Device: deviceName, Address: clientAddresses[i]})
+	}
 
-func main() {
-	addy, err := net.ResolveTCPAddr("tcp", "0.0.0.0:12345")
+	// Setting the link "up"
+	err = netlink.LinkSetUp(device)
 	if err != nil {
-		log.Fatal(err)
+		return newError(types.ErrInternal, "error setting up device", err)
 	}
-	inbound, err := net.ListenTCP("tcp", addy)
-	if err != nil {
-		log.Fatal(err)
+
+	// Block everything that does not go through the tunnel. The kill
+	// switch stays in place if the tunnel goes away, until the user
+	// disconnects.
+	if configData.KillSwitch || config.KillSwitch {
+		spec := &killSwitchSpec{
+			Device:        deviceName,
+			ServerAddress: configData.ServerAddress,
+			ServerPort:    serverPort,
+			FirewallMark:  state.FirewallMark,
+			Bypass:        configData.ExcludeRanges,
+		}
+		err = enableKillSwitch(spec)
+		undo.record(action{Kind: actionKillSwitch, KillSwitch: spec})
+		if err != nil {
+			return err
+		}
 	}
-	listener := new(Listener)
-	rpc.Register(listener)
-	rpc.Accept(inbound)
-}
 
-// configureIpRoutes accepts a boolean. If it is true, the system's IP rules
-// will be configured to utilize the VPN. If it's false, those configurations
-// will be removed
-func configureIpRules(enable bool, routingNet *net.IPNet, tableIndex int) {
-
-	rule1 := netlink.NewRule()
-	rule1.Invert = true
-	rule1.Src = routingNet
-	rule1.Mark = tableIndex
-	rule1.Table = tableIndex
-	rule1.Family = 4 // IPv4
-
-	rule2 := netlink.NewRule()
-	rule2.Src = routingNet
-	rule2.SuppressPrefixlen = 0
-	rule2.Table = unix.RT_TABLE_MAIN
-	rule2.Family = 4 // IPv4
-
-	if enable {
-		err := netlink.RuleAdd(rule1)
+	// Mark the traffic of applications launched with "wb exec", unless an
+	// earlier tunnel already does. Only a tunnel that is just for those
+	// applications depends on it.
+	if tunnelWith(actionAppMarks, deviceName) == nil {
+		err = markApps(undo)
 		if err != nil {
-			log.Fatal("error adding network rule: ", err)
+			if configData.AppsOnly {
+				return err
+			}
+			log.Print("error marking application traffic, application policies have no effect: ", err)
 		}
+	}
 
-		err = netlink.RuleAdd(rule2)
+	// Configure The Network Interface route through the link
+	for _, routedNet := range routedNets {
+		err = configureIpRoutes(undo, device, state.Table, routedNet.String())
 		if err != nil {
-			log.Fatal("error adding network rule: ", err)
+			return err
 		}
-	} else {
-		err := netlink.RuleDel(rule1)
+	}
+
+	// Without an IPv6 range IPv6 would bypass the tunnel, so unless that is
+	// allowed it goes to routes in the tunnel's table that drop it
+	var blockedNets []netip.Prefix
+	if config.IPv6LeakProtection != ipv6PolicyOff {
+		blockedNets = leakRanges(configData)
+	}
+	for _, blockedNet := range blockedNets {
+		err = blockIpRoutes(undo, state.Table, blockedNet.String(), config.IPv6LeakProtection)
 		if err != nil {
-			log.Fatal("error deleting network rule: ", err)
+			return err
 		}
+		state.IPv6Policy = config.IPv6LeakProtection
+	}
+	return nil
+}
+
+// activateTunnel sends traffic into a tunnel brought up by setupTunnel, and
+// DNS lookups to its DNS servers.
+func activateTunnel(configData types.ConfigData, state *tunnelState) error {
+	undo := &state.Undo
+
+	routedNets, err := tunnelRanges(configData)
+	if err != nil {
+		return err
+	}
+	allowedNets, err := allowedRanges(configData, routedNets)
+	if err != nil {
+		return err
+	}
+	var blockedNets []netip.Prefix
+	if len(state.IPv6Policy) > 0 {
+		blockedNets = leakRanges(configData)
+	}
 
-		err = netlink.RuleDel(rule2)
+	// Send each address family with routes in the tunnel's table there
+	err = configureIpRules(undo, tunnelRules(state, allowedNets, blockedNets))
+	if err != nil {
+		return err
+	}
+
+	// With tunneled domains the system asks the forwarder, which routes
+	// their addresses through the tunnel as they are resolved
+	dnsServers := configData.DNSServers
+	if len(configData.TunnelDomains) > 0 {
+		clientAddress, err := netip.ParsePrefix(state.ClientAddress)
+		if err != nil {
+			return newError(types.ErrInvalidConfig, "error parsing client address", err)
+		}
+		forwarder := &forwarderSpec{
+			Address:   net.JoinHostPort(clientAddress.Addr().String(), "53"),
+			Upstreams: configData.DNSServers,
+			Domains:   configData.TunnelDomains,
+			Device:    state.Device,
+			Table:     state.Table,
+			IPv6:      len(configData.ClientAddress6) > 0,
+		}
+		err = startForwarder(undo, forwarder)
 		if err != nil {
-			log.Fatal("error deleting network rule: ", err)
+			return err
 		}
+		dnsServers = []string{clientAddress.Addr().String()}
+	}
+
+	// Now that lookups go through the tunnel, send them to its DNS servers
+	if len(dnsServers) > 0 {
+		return configureDNS(undo, state.Device, dnsServers, configData.SearchDomains)
+	}
+	return nil
+}
+
+// allowedRanges returns the ranges the server may send from. With tunneled
+// domains that is any address of the tunnel's families, as the addresses of
+// the domains are only known once they are resolved.
+func allowedRanges(configData types.ConfigData, routedNets []netip.Prefix) ([]netip.Prefix, error) {
+	if len(configData.TunnelDomains) == 0 {
+		return routedNets, nil
 	}
+	if len(configData.DNSServers) == 0 {
+		return nil, newError(types.ErrInvalidConfig, "tunneling domains needs DNS servers to resolve them", nil)
+	}
+	return familyRanges(configData), nil
 }
 
-// configureIpRoutes accepts a boolean. If it is true, the system's IP routes
-// will be configured to utilize the VPN. If it's false, those configurations
-// will be removed.
-func configureIpRoutes(enable bool, deviceIndex int, tableIndex int, routingNet *net.IPNet) {
+// serverPeer returns the wireguard peer of the server, which may send from
+// allowedNets.
+func serverPeer(configData types.ConfigData, allowedNets []netip.Prefix) (wgtypes.PeerConfig, error) {
+	serverPublicKey, err := wgtypes.ParseKey(string(configData.ServerPublicKeyData))
+	if err != nil {
+		return wgtypes.PeerConfig{}, newError(types.ErrInvalidKey, "error parsing server public key", err)
+	}
 
-	if enable {
-		route := netlink.Route{
-			Dst:       routingNet,
-			LinkIndex: deviceIndex,
-			Table:     tableIndex,
-			Scope:     unix.RT_SCOPE_LINK,
+	serverIp := net.ParseIP(configData.ServerAddress)
+	if serverIp == nil {
+		msg := fmt.Sprintf("invalid server address %q", configData.ServerAddress)
+		return wgtypes.PeerConfig{}, newError(types.ErrInvalidConfig, msg, nil)
+	}
+	if configData.PersistentKeepalive < 0 || configData.PersistentKeepalive > MAX_KEEPALIVE {
+		msg := fmt.Sprintf("invalid keepalive %d, it has to be between 0 and %d seconds", configData.PersistentKeepalive, MAX_KEEPALIVE)
+		return wgtypes.PeerConfig{}, newError(types.ErrInvalidConfig, msg, nil)
+	}
+	keepalive := time.Duration(configData.PersistentKeepalive) * time.Second
+
+	var allowIpsFromServer []net.IPNet
+	for _, allowedNet := range allowedNets {
+		allowIpsFromServer = append(allowIpsFromServer, net.IPNet{
+			IP:   allowedNet.Addr().AsSlice(),
+			Mask: net.CIDRMask(allowedNet.Bits(), allowedNet.Addr().BitLen()),
+		})
+	}
+	return wgtypes.PeerConfig{
+		PublicKey:  serverPublicKey,
+		AllowedIPs: allowIpsFromServer,
+		Endpoint: &net.UDPAddr{
+			IP:   serverIp,
+			Port: configData.ServerPort,
+		},
+		PersistentKeepaliveInterval: &keepalive,
+	}, nil
+}
+
+// clientAddrs returns the client's addresses, as given and parsed. IPv6 is
+// only there when the server's interface has an IPv6 range.
+func clientAddrs(configData types.ConfigData) ([]string, []*netlink.Addr, error) {
+	clientAddresses := []string{configData.ClientAddress}
+	if len(configData.ClientAddress6) > 0 {
+		clientAddresses = append(clientAddresses, configData.ClientAddress6)
+	}
+
+	var addresses []*netlink.Addr
+	for _, clientAddress := range clientAddresses {
+		address, err := netlink.ParseAddr(clientAddress)
+		if err != nil {
+			return nil, nil, newError(types.ErrInvalidConfig, "error parsing client address", err)
+		}
+		if address.IP.To4() == nil {
+			// There are no other hosts on the link to detect duplicates with
+			address.Flags |= unix.IFA_F_NODAD
+		}
+		addresses = append(addresses, address)
+	}
+	return clientAddresses, addresses, nil
+}
+
+// tunnelRules returns the IP rules that send each address family with
+// routes in the tunnel's table there.
+func tunnelRules(state *tunnelState, allowedNets []netip.Prefix, blockedNets []netip.Prefix) []ruleSpec {
+	var rules []ruleSpec
+	for _, familyNet := range []netip.Prefix{netip.MustParsePrefix(ALL_NETWORK_RANGE), netip.MustParsePrefix(ALL_NETWORK_RANGE6)} {
+		if !anyInFamily(allowedNets, familyNet) && !anyInFamily(blockedNets, familyNet) {
+			continue
 		}
-		err := netlink.RouteReplace(&route)
+		priority := tunnelPriority(state)
+		if state.AppsOnly {
+			rules = append(rules, appRules(familyNet.String(), state.Table, priority, APP_TUNNEL_MARK)...)
+		} else {
+			rules = append(rules, ipRules(familyNet.String(), state.Table, priority)...)
+		}
+	}
+	return rules
+}
+
+// tunnelPriority returns the first of the two priorities of the tunnel's
+// rules. Tunnels for ranges, domains or applications come first, as the
+// traffic they take would otherwise go into a tunnel for everything.
+func tunnelPriority(state *tunnelState) int {
+	priority := RULE_PRIORITY_TUNNELS + 2*tunnelIndex(state.Device)
+	if len(state.IncludeRanges) == 0 && len(state.TunnelDomains) == 0 && !state.AppsOnly {
+		priority += 2 * MAX_TUNNELS
+	}
+	return priority
+}
+
+// endpointRules returns the rules that send the packets marked with the
+// tunnel's firewall mark, which are the ones to its server, to the main
+// table before any tunnel's rules see them.
+func endpointRules(mark int) []ruleSpec {
+	var rules []ruleSpec
+	for _, familyNet := range []string{ALL_NETWORK_RANGE, ALL_NETWORK_RANGE6} {
+		rules = append(rules, ruleSpec{
+			Priority:          RULE_PRIORITY_ENDPOINTS,
+			Src:               familyNet,
+			Table:             unix.RT_TABLE_MAIN,
+			Mark:              mark,
+			SuppressPrefixlen: -1,
+		})
+	}
+	return rules
+}
+
+func isEndpointRule(a action) bool {
+	return a.Kind == actionRule && a.Rule.Priority == RULE_PRIORITY_ENDPOINTS
+}
+
+func main() {
+	socketPath := flag.String("socket", DEFAULT_SOCKET_PATH, "Path of the Unix socket to serve the RPC API on")
+	socketGroup := flag.String("group", DEFAULT_SOCKET_GROUP, "Group whose members may use the RPC API")
+	tcpAddress := flag.String("tcp", "", "Also serve the RPC API over TCP on this address (unauthenticated)")
+	flag.StringVar(&stateDir, "state-dir", DEFAULT_STATE_DIR, "Directory to keep the tunnel state in")
+	configPath := flag.String("config", DEFAULT_CONFIG_PATH, "Path of the configuration file")
+	firewallName := flag.String("firewall", "auto", "Firewall backend to use: nftables, iptables or auto")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	// The helper for "wb exec" in a namespace, not a command of its own
+	if flag.Arg(0) == "nsexec" {
+		err := nsexec(flag.Args()[1:])
+		log.Fatal("error running command in namespace: ", err)
+	}
+
+	if flag.Arg(0) == "version" {
+		fmt.Printf("wbd %s (API version %d)\n", version, types.API_VERSION)
+		return
+	}
+
+	var err error
+	fw, err = selectFirewall(*firewallName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fw != nil {
+		log.Printf("using the %s firewall backend", fw.name())
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "cleanup":
+		err = cleanup()
 		if err != nil {
-			log.Fatal("error adding new route: ", err)
+			log.Fatal("error cleaning up: ", err)
 		}
+		fmt.Println("Removed all network configuration made by wbd")
+		return
+	default:
+		printUsage()
+		os.Exit(2)
+	}
+
+	config, err = loadConfig(*configPath)
+	if err != nil {
+		log.Fatal("error loading configuration: ", err)
+	}
+
+	// Pick up the tunnels a previous run of the daemon left up, and remove
+	// whatever it left behind that is not part of them
+	states, err := loadStates()
+	if err != nil {
+		log.Print("error loading tunnel state: ", err)
+	}
+	for _, state := range reconcileOnStartup(states) {
+		tunnels[state.Device] = state
+		state.setConnState(types.StateConnecting)
+	}
+	go monitorTunnels()
+	go watchNetwork()
+	go watchSleep()
+
+	listener := new(Listener)
+	rpc.Register(listener)
 
+	// Resolve the group that may talk to the daemon. Without it only root
+	// can use the socket.
+	gid := -1
+	group, err := user.LookupGroup(*socketGroup)
+	if err != nil {
+		log.Printf("group %s not found, only root may connect: %v", *socketGroup, err)
 	} else {
-		link, err := netlink.LinkByIndex(deviceIndex)
+		gid, err = strconv.Atoi(group.Gid)
 		if err != nil {
-			log.Fatal("error getting link by index: ", err)
+			log.Fatal("error parsing group id: ", err)
 		}
+	}
 
-		routeList, err := netlink.RouteList(link, 4)
+	if len(*tcpAddress) > 0 {
+		log.Printf("WARNING: serving unauthenticated RPC on tcp %s", *tcpAddress)
+		addy, err := net.ResolveTCPAddr("tcp", *tcpAddress)
 		if err != nil {
-			log.Fatal("error listing routes: ", err)
+			log.Fatal(err)
 		}
-
-		for _, route := range routeList {
-			if route.Table == tableIndex {
-				err := netlink.RouteDel(&route)
-				if err != nil {
-					log.Fatal("error deleting route: ", err)
-				}
-			}
+		inbound, err := net.ListenTCP("tcp", addy)
+		if err != nil {
+			log.Fatal(err)
 		}
+		go rpc.Accept(inbound)
+	}
 
+	inbound, err := listenUnix(*socketPath, gid)
+	if err != nil {
+		log.Fatal("error creating socket: ", err)
 	}
+	serveUnix(inbound, gid)
+}
+
+func printUsage() {
+	fmt.Fprintln(flag.CommandLine.Output(), "usage: wbd [<options>] [<command>]")
+	fmt.Fprintln(flag.CommandLine.Output(), "Available commands are:")
+	fmt.Fprintln(flag.CommandLine.Output(), " cleanup   Remove all tunnels, rules and routes made by wbd and exit")
+	fmt.Fprintln(flag.CommandLine.Output(), " version   Print the version of wbd and exit")
+	fmt.Fprintln(flag.CommandLine.Output(), "Options:")
+	flag.PrintDefaults()
 }
 
-// configureIptables accepts a boolean. If it is true, the system's IP tables
-// will be configured for using the VPN. If it's false, the IP tables
-// configuration will be cleared out.
-func configureIptables(enable bool, deviceName string, serverIp string) {
-
-	mangleRuleSpecPost := fmt.Sprintf("-m mark --mark 51820 -p udp -j CONNMARK --save-mark --comment \"White Box VPN rule for %s\"", deviceName)
-	mangleRuleSpecPre := fmt.Sprintf("-p udp -j CONNMARK --restore-mark --comment \"White Box VPN rule for  %s\"", deviceName)
-	rawRuleSpecPost := fmt.Sprintf("! -i %s -d %s -m addrtype ! --src-type LOCAL -j DROP --comment \"White Box VPN rule for %s\"", deviceName, serverIp, deviceName)
-	ipt, err := iptables.New()
-	if enable {
-		// Configure IPTables
+// ipRules returns the IP rules that send all traffic from routingNet, apart
+// from the tunnel's own packets, through the tunnel's routing table. The
+// rules take the given priority and the one after it.
+func ipRules(routingNet string, tableIndex int, priority int) []ruleSpec {
+
+	// Everything not marked by wireguard uses the tunnel's table
+	rule1 := ruleSpec{
+		Priority:          priority + 1,
+		Src:               routingNet,
+		Table:             tableIndex,
+		Mark:              tableIndex,
+		Invert:            true,
+		SuppressPrefixlen: -1,
+	}
+
+	// Except routes more specific than the default route in the main table
+	rule2 := ruleSpec{
+		Priority:          priority,
+		Src:               routingNet,
+		Table:             unix.RT_TABLE_MAIN,
+		Mark:              -1,
+		SuppressPrefixlen: 0,
+	}
+
+	return []ruleSpec{rule1, rule2}
+}
+
+// appRules returns the IP rules that only send traffic from routingNet that
+// carries the application mark through the tunnel's routing table.
+func appRules(routingNet string, tableIndex int, priority int, mark int) []ruleSpec {
+	rules := ipRules(routingNet, tableIndex, priority)
+	rules[0].Mark = mark
+	rules[0].Invert = false
+	return rules
+}
+
+// configureIpRules configures the system's IP rules to utilize the VPN. Each
+// rule that is added is recorded in undo.
+func configureIpRules(undo *undoLog, rules []ruleSpec) error {
+	for _, spec := range rules {
+		spec := spec
+		rule, err := spec.netlinkRule()
 		if err != nil {
-			log.Fatal("error creating new iptables: ", err)
+			return newError(types.ErrInternal, "error parsing network rule", err)
 		}
-		ipt.Insert("mangle", "PREROUTING", 1, mangleRuleSpecPre)
-		ipt.Insert("mangle", "POSTROUTING", 1, mangleRuleSpecPost)
-		ipt.Insert("raw", "PREROUTING", 1, rawRuleSpecPost)
-	} else {
-		ipt.DeleteIfExists("mangle", "PREROUTING", mangleRuleSpecPre)
-		ipt.DeleteIfExists("mangle", "POSTROUTING", mangleRuleSpecPost)
-		ipt.DeleteIfExists("raw", "PREROUTING", rawRuleSpecPost)
+		err = netlink.RuleAdd(rule)
+		if err != nil {
+			return newError(types.ErrRuleConflict, "error adding network rule", err)
+		}
+		undo.record(action{Kind: actionRule, Rule: &spec})
+	}
+	return nil
+}
+
+// configureIpRoutes configures the system's IP routes to utilize the VPN.
+// The route that is added is recorded in undo.
+func configureIpRoutes(undo *undoLog, device netlink.Link, tableIndex int, routingNet string) error {
+	spec := routeSpec{
+		Dst:    routingNet,
+		Device: device.Attrs().Name,
+		Table:  tableIndex,
+	}
+	route, err := spec.netlinkRoute()
+	if err != nil {
+		return newError(types.ErrInternal, "error building route", err)
+	}
+	err = netlink.RouteReplace(route)
+	if err != nil {
+		return newError(types.ErrInternal, "error adding new route", err)
+	}
+	undo.record(action{Kind: actionRoute, Route: &spec})
+	return nil
+}
+
+// blockIpRoutes adds a route to the tunnel's table that rejects or silently
+// drops traffic to blockedNet, depending on policy. The route that is added
+// is recorded in undo.
+func blockIpRoutes(undo *undoLog, tableIndex int, blockedNet string, policy string) error {
+	spec := blockRouteSpec(tableIndex, blockedNet, policy)
+	route, err := spec.netlinkRoute()
+	if err != nil {
+		return newError(types.ErrInternal, "error building route", err)
+	}
+	err = netlink.RouteReplace(route)
+	if err != nil {
+		return newError(types.ErrInternal, "error adding blocking route", err)
+	}
+	undo.record(action{Kind: actionRoute, Route: &spec})
+	return nil
+}
+
+// blockRouteSpec describes the route that rejects or silently drops traffic
+// to blockedNet, depending on policy.
+func blockRouteSpec(tableIndex int, blockedNet string, policy string) routeSpec {
+	spec := routeSpec{
+		Dst:   blockedNet,
+		Table: tableIndex,
+		Type:  routeTypeUnreachable,
+	}
+	if policy == ipv6PolicyBlackhole {
+		spec.Type = routeTypeBlackhole
 	}
+	return spec
 }
@@ -0,0 +1,223 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+// testTunnel is a tunnel of a test's tunnel set, with the ranges it routes.
+type testTunnel struct {
+	state  *tunnelState
+	routed []netip.Prefix
+}
+
+func fullTunnel(device string, table int) testTunnel {
+	return testTunnel{
+		state:  &tunnelState{Device: device, Table: table, FirewallMark: table},
+		routed: prefixes(ALL_NETWORK_RANGE),
+	}
+}
+
+func splitTunnel(device string, table int, ranges ...string) testTunnel {
+	return testTunnel{
+		state:  &tunnelState{Device: device, Table: table, FirewallMark: table, IncludeRanges: ranges},
+		routed: prefixes(ranges...),
+	}
+}
+
+func (tunnel testTunnel) rules() []ruleSpec {
+	return tunnelRules(tunnel.state, tunnel.routed, nil)
+}
+
+func TestTunnelRulesOrder(t *testing.T) {
+	apps := fullTunnel("wb1", 0x57420101)
+	apps.state.AppsOnly = true
+	domains := fullTunnel("wb1", 0x57420101)
+	domains.state.TunnelDomains = []string{"corp.example"}
+	excluding := fullTunnel("wb0", 0x57420100)
+	excluding.state.ExcludeRanges = []string{"192.168.0.0/16"}
+	last := fullTunnel(fmt.Sprintf("wb%d", MAX_TUNNELS-1), 0x57420101)
+
+	tests := []struct {
+		name string
+
+		// The tunnels in the order their rules have to be in
+		tunnels []testTunnel
+	}{
+		{"full wb0, split wb1", []testTunnel{splitTunnel("wb1", 0x57420101, "10.0.0.0/8"), fullTunnel("wb0", 0x57420100)}},
+		{"split wb0, full wb1", []testTunnel{splitTunnel("wb0", 0x57420100, "10.0.0.0/8"), fullTunnel("wb1", 0x57420101)}},
+		{"full wb0, applications wb1", []testTunnel{apps, fullTunnel("wb0", 0x57420100)}},
+		{"full wb0, domains wb1", []testTunnel{domains, fullTunnel("wb0", 0x57420100)}},
+		{"full wb0 with exclusions, split wb1", []testTunnel{splitTunnel("wb1", 0x57420101, "10.0.0.0/8"), excluding}},
+		{"two full tunnels", []testTunnel{fullTunnel("wb0", 0x57420100), fullTunnel("wb1", 0x57420101)}},
+		{"two split tunnels", []testTunnel{splitTunnel("wb0", 0x57420100, "10.0.0.0/8"), splitTunnel("wb1", 0x57420101, "172.16.0.0/12")}},
+		{"split wb0, last full tunnel", []testTunnel{splitTunnel("wb0", 0x57420100, "10.0.0.0/8"), last}},
+	}
+	for _, test := range tests {
+		previous := RULE_PRIORITY_ENDPOINTS
+		for _, tunnel := range test.tunnels {
+			rules := tunnel.rules()
+			if len(rules) == 0 {
+				t.Fatalf("%s: %s has no rules", test.name, tunnel.state.Device)
+			}
+			for _, rule := range rules {
+				if rule.Priority <= previous {
+					t.Errorf("%s: %s has a rule at %d, not behind %d", test.name, tunnel.state.Device, rule.Priority, previous)
+				}
+				owned := netlink.NewRule()
+				owned.Priority = rule.Priority
+				if !ownedRule(*owned) {
+					t.Errorf("%s: %s has a rule at %d, outside the daemon's band", test.name, tunnel.state.Device, rule.Priority)
+				}
+			}
+			for _, rule := range rules {
+				if rule.Priority > previous {
+					previous = rule.Priority
+				}
+			}
+		}
+	}
+}
+
+// sourceFor returns the address the kernel picks to send to dst from a
+// socket with the firewall mark, which tells the route the rules led to.
+func sourceFor(t *testing.T, dst string, mark int) string {
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		controlErr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}}
+	conn, err := dialer.Dial("udp4", net.JoinHostPort(dst, "51820"))
+	if err != nil {
+		t.Fatalf("no route to %s with mark %#x: %v", dst, mark, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// TestTunnelRulesRouting installs the rules of a tunnel for everything on
+// wb0 and a tunnel for 10.0.0.0/8 on wb1, and checks where traffic and
+// each tunnel's own packets go.
+func TestTunnelRulesRouting(t *testing.T) {
+	enterTestNamespace(t, "wb0")
+	mustNetlink(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "wb1"}, PeerName: "wb1p"}))
+	mustNetlink(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "lan0"}, PeerName: "lan0p"}))
+	for _, name := range []string{"wb0p", "wb1p", "lan0p"} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustNetlink(t, netlink.LinkSetUp(link))
+	}
+	addAddress(t, "lan0", "192.168.1.2/24")
+	addAddress(t, "wb0", "10.64.0.2/32")
+	addAddress(t, "wb1", "100.65.0.2/32")
+	mustNetlink(t, netlink.RouteAdd(&netlink.Route{Gw: net.ParseIP("192.168.1.1")}))
+
+	full := fullTunnel("wb0", 0x57420100)
+	split := splitTunnel("wb1", 0x57420101, "10.0.0.0/8")
+	var undo undoLog
+	for _, tunnel := range []testTunnel{full, split} {
+		link, err := netlink.LinkByName(tunnel.state.Device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, routed := range tunnel.routed {
+			err = configureIpRoutes(&undo, link, tunnel.state.Table, routed.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = configureIpRules(&undo, append(endpointRules(tunnel.state.FirewallMark), tunnel.rules()...))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		dst  string
+		mark int
+		want string
+	}{
+		{"traffic for the split tunnel", "10.1.2.3", 0, "100.65.0.2"},
+		{"everything else", "203.0.113.1", 0, "10.64.0.2"},
+		{"split tunnel's packets to its server", "203.0.113.1", split.state.FirewallMark, "192.168.1.2"},
+		{"split tunnel's packets to a server in its range", "10.1.2.3", split.state.FirewallMark, "192.168.1.2"},
+		{"full tunnel's packets to its server", "203.0.113.1", full.state.FirewallMark, "192.168.1.2"},
+		{"full tunnel's packets to a server in the split range", "10.1.2.3", full.state.FirewallMark, "192.168.1.2"},
+	}
+	for _, test := range tests {
+		got := sourceFor(t, test.dst, test.mark)
+		if got != test.want {
+			t.Errorf("%s: sent from %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	err := undo.rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckExclusive(t *testing.T) {
+	alpha := &tunnelState{Device: "wb0", ServerName: "alpha"}
+	beta := &tunnelState{Device: "wb1", ServerName: "beta", AppsOnly: true}
+	tunnels = map[string]*tunnelState{alpha.Device: alpha, beta.Device: beta}
+	defer func() { tunnels = map[string]*tunnelState{} }()
+
+	tests := []struct {
+		name       string
+		configData types.ConfigData
+		replaced   *tunnelState
+		want       types.ErrorCode
+	}{
+		{"new server", types.ConfigData{ServerName: "gamma"}, nil, ""},
+		{"server with a tunnel", types.ConfigData{ServerName: "alpha"}, nil, types.ErrTunnelExists},
+		{"replacing the server's tunnel", types.ConfigData{ServerName: "alpha"}, alpha, ""},
+		{"replacing another server's tunnel", types.ConfigData{ServerName: "beta"}, alpha, types.ErrTunnelExists},
+		{"replacing with a new server", types.ConfigData{ServerName: "gamma"}, alpha, ""},
+		{"second tunnel for applications", types.ConfigData{ServerName: "gamma", AppsOnly: true}, nil, types.ErrInvalidConfig},
+		{"replacing the tunnel for applications", types.ConfigData{ServerName: "gamma", AppsOnly: true}, beta, ""},
+	}
+	for _, test := range tests {
+		err := checkExclusive(test.configData, test.replaced)
+		var got types.ErrorCode
+		if err != nil {
+			got = types.ParseRPCError(err).Code
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// How often the monitor looks at the tunnels' handshakes
+const MONITOR_INTERVAL = 5 * time.Second
+
+// Wireguard drops a session after REJECT_AFTER_TIME, so a handshake older
+// than that means the tunnel has not talked to its server since.
+const HANDSHAKE_STALE_AFTER = 180 * time.Second
+
+// How long a new tunnel may go without a handshake before it is down, and
+// how long a probe of an established one may take
+const CONNECT_TIMEOUT = 30 * time.Second
+const PROBE_TIMEOUT = 15 * time.Second
+
+// The keepalive that makes a device talk to its server straight away,
+// which starts a handshake when there is no session
+const PROBE_KEEPALIVE = 1 * time.Second
+
+// Reconnect attempts back off from RECONNECT_BACKOFF_MIN, doubling up to
+// RECONNECT_BACKOFF_MAX.
+const RECONNECT_BACKOFF_MIN = 5 * time.Second
+const RECONNECT_BACKOFF_MAX = 5 * time.Minute
+
+// MAX_KEEPALIVE is the longest keepalive interval wireguard takes, in
+// seconds.
+const MAX_KEEPALIVE = 65535
+
+// connection is what the monitor knows about a tunnel's connection.
+type connection struct {
+	state        string
+	since        time.Time
+	probing      bool
+	probeStarted time.Time
+	retryAt      time.Time
+	retries      int
+}
+
+// setConnState moves the tunnel's connection into a new state, which
+// clients learn from the tunnel's status. A tunnel that starts connecting
+// starts over.
+func (s *tunnelState) setConnState(connState string) {
+	if s.conn.state == connState {
+		return
+	}
+	if connState == types.StateConnecting {
+		s.conn = connection{}
+	}
+	log.Printf("tunnel %s is %s", s.Device, connState)
+	s.conn.state = connState
+	s.conn.since = time.Now()
+
+	// A tunnel that is down is reconnecting, or it is gone for good and
+	// there is an error saying why
+	kinds := map[string]string{
+		types.StateConnecting: types.EventConnecting,
+		types.StateUp:         types.EventConnected,
+		types.StateStale:      types.EventHandshakeStale,
+	}
+	kind, ok := kinds[connState]
+	if ok {
+		emitEvent(kind, s.Device, s.ServerName, "")
+	}
+}
+
+// monitorTunnels checks the connection of every tunnel, for as long as the
+// daemon runs.
+func monitorTunnels() {
+	last := time.Now()
+	for now := range time.Tick(MONITOR_INTERVAL) {
+		// The monotonic clock stands still while the system sleeps, the
+		// wall clock does not
+		if now.Round(0).Sub(last.Round(0))-now.Sub(last) > SLEEP_DETECT_THRESHOLD {
+			resumed(now)
+		}
+		last = now
+
+		tunnelLock.Lock()
+		for _, state := range sortedTunnels() {
+			err := checkConnection(state, time.Now())
+			if err != nil {
+				log.Printf("error checking tunnel %s: %v", state.Device, err)
+				emitEvent(types.EventError, state.Device, state.ServerName, types.ParseRPCError(err).Message)
+			}
+		}
+		tunnelLock.Unlock()
+	}
+}
+
+// checkConnection moves the tunnel's connection along by its latest
+// handshake. Sessions of idle tunnels expire just like those of dead ones,
+// so an expired session first gets a probe, and only a probe that brings no
+// handshake makes the tunnel stale and reconnect.
+func checkConnection(state *tunnelState, now time.Time) error {
+	var peer *wgtypes.Peer
+	err := withWireguard(state, func(c *wgctrl.Client) error {
+		device, err := c.Device(state.Device)
+		if err != nil {
+			return err
+		}
+		if len(device.Peers) > 0 {
+			peer = &device.Peers[0]
+		}
+		return nil
+	})
+	if os.IsNotExist(err) || (err == nil && peer == nil) {
+		// Without its device or peer the tunnel cannot come back, it can
+		// only be disconnected
+		if state.conn.state != types.StateDown {
+			emitEvent(types.EventError, state.Device, state.ServerName, "the tunnel's device is gone, disconnect to clean up")
+		}
+		state.setConnState(types.StateDown)
+		return nil
+	}
+	if err != nil {
+		return newError(types.ErrInternal, "error reading device", err)
+	}
+
+	if !peer.LastHandshakeTime.IsZero() && now.Sub(peer.LastHandshakeTime) < HANDSHAKE_STALE_AFTER {
+		state.conn.retries = 0
+		state.setConnState(types.StateUp)
+		if state.conn.probing {
+			return stopProbe(state, peer.PublicKey)
+		}
+		return nil
+	}
+
+	switch state.conn.state {
+	case types.StateConnecting:
+		if !state.conn.probing {
+			err = startProbe(state, peer.PublicKey, now)
+		}
+		if now.Sub(state.conn.since) < CONNECT_TIMEOUT {
+			return err
+		}
+		state.setConnState(types.StateDown)
+	case types.StateUp:
+		if !state.conn.probing {
+			return startProbe(state, peer.PublicKey, now)
+		}
+		if now.Sub(state.conn.probeStarted) < PROBE_TIMEOUT {
+			return nil
+		}
+		state.setConnState(types.StateStale)
+	default:
+		if now.Before(state.conn.retryAt) {
+			return nil
+		}
+		state.setConnState(types.StateDown)
+	}
+	return reconnect(state, now)
+}
+
+// reconnect renews the tunnel's peer, backing off from attempt to attempt.
+func reconnect(state *tunnelState, now time.Time) error {
+	state.conn.retries++
+	backoff := RECONNECT_BACKOFF_MIN
+	for i := 1; i < state.conn.retries && backoff < RECONNECT_BACKOFF_MAX; i++ {
+		backoff *= 2
+	}
+	if backoff > RECONNECT_BACKOFF_MAX {
+		backoff = RECONNECT_BACKOFF_MAX
+	}
+	state.conn.retryAt = now.Add(backoff)
+	log.Printf("reconnecting tunnel %s to %s, attempt %d", state.Device, state.ServerName, state.conn.retries)
+	emitEvent(types.EventReconnecting, state.Device, state.ServerName, fmt.Sprintf("attempt %d", state.conn.retries))
+	return renewPeer(state, now)
+}
+
+// renewPeer configures the tunnel's peer anew at the server's address,
+// undoing any roaming to an address that no longer works. The address is
+// the IP the server was configured with, which the kill switch also allows,
+// so there is no name to resolve again. Removing the peer first drops its
+// session, so that a new handshake starts straight away with a probe. It
+// also brings the link back up, in case something took it down.
+func renewPeer(state *tunnelState, now time.Time) error {
+	serverIp := net.ParseIP(state.ServerAddress)
+	if serverIp == nil {
+		return newError(types.ErrInvalidConfig, fmt.Sprintf("invalid server address %q", state.ServerAddress), nil)
+	}
+	endpoint := &net.UDPAddr{IP: serverIp, Port: state.ServerPort}
+	return withWireguard(state, func(c *wgctrl.Client) error {
+		link, err := netlink.LinkByName(state.Device)
+		if err != nil {
+			return newError(types.ErrLinkNotFound, "error finding link", err)
+		}
+		err = netlink.LinkSetUp(link)
+		if err != nil {
+			return newError(types.ErrInternal, "error setting link up", err)
+		}
+
+		device, err := c.Device(state.Device)
+		if err != nil || len(device.Peers) == 0 {
+			return newError(types.ErrLinkNotFound, fmt.Sprintf("error reading device %s", state.Device), err)
+		}
+		peer := device.Peers[0]
+		err = c.ConfigureDevice(state.Device, wgtypes.Config{Peers: []wgtypes.PeerConfig{{
+			PublicKey: peer.PublicKey,
+			Remove:    true,
+		}}})
+		if err != nil {
+			return newError(types.ErrInternal, "error removing peer", err)
+		}
+
+		keepalive := PROBE_KEEPALIVE
+		renewed := wgtypes.PeerConfig{
+			PublicKey:                   peer.PublicKey,
+			Endpoint:                    endpoint,
+			PersistentKeepaliveInterval: &keepalive,
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  peer.AllowedIPs,
+		}
+		if peer.PresharedKey != (wgtypes.Key{}) {
+			renewed.PresharedKey = &peer.PresharedKey
+		}
+		err = c.ConfigureDevice(state.Device, wgtypes.Config{Peers: []wgtypes.PeerConfig{renewed}})
+		if err != nil {
+			return newError(types.ErrInternal, "error configuring peer", err)
+		}
+		state.conn.probing = true
+		state.conn.probeStarted = now
+		return nil
+	})
+}
+
+// startProbe has the tunnel's peer send keepalives often, which starts a
+// handshake when there is no session.
+func startProbe(state *tunnelState, publicKey wgtypes.Key, now time.Time) error {
+	err := setKeepalive(state, publicKey, PROBE_KEEPALIVE)
+	if err != nil {
+		return err
+	}
+	state.conn.probing = true
+	state.conn.probeStarted = now
+	return nil
+}
+
+// stopProbe puts back the keepalive the tunnel was configured with.
+func stopProbe(state *tunnelState, publicKey wgtypes.Key) error {
+	err := setKeepalive(state, publicKey, time.Duration(state.PersistentKeepalive)*time.Second)
+	if err != nil {
+		return err
+	}
+	state.conn.probing = false
+	return nil
+}
+
+func setKeepalive(state *tunnelState, publicKey wgtypes.Key, interval time.Duration) error {
+	return withWireguard(state, func(c *wgctrl.Client) error {
+		err := c.ConfigureDevice(state.Device, wgtypes.Config{Peers: []wgtypes.PeerConfig{{
+			PublicKey:                   publicKey,
+			UpdateOnly:                  true,
+			PersistentKeepaliveInterval: &interval,
+		}}})
+		if err != nil {
+			return newError(types.ErrInternal, "error setting keepalive", err)
+		}
+		return nil
+	})
+}
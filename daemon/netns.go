@@ -0,0 +1,244 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+// Namespaced tunnels live in this network namespace, which "ip netns" also
+// knows about.
+const NETNS_NAME = "whitebox"
+const NETNS_RUN_DIR = "/run/netns"
+const NETNS_ETC_DIR = "/etc/netns"
+
+// inNamespace runs fn on a thread that is in the named network namespace,
+// and moves the thread back afterwards. Processes started by fn start in
+// the namespace too.
+func inNamespace(name string, fn func() error) error {
+	runtime.LockOSThread()
+
+	original, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer original.Close()
+
+	target, err := netns.GetFromName(name)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer target.Close()
+
+	err = netns.Set(target)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	fnErr := fn()
+
+	// A thread that cannot go back is left locked, so that Go throws it
+	// away instead of running other goroutines in the wrong namespace
+	err = netns.Set(original)
+	if err != nil {
+		return err
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+// createNamespace creates the named network namespace and records it in
+// undo.
+func createNamespace(undo *undoLog, name string, device string) error {
+	runtime.LockOSThread()
+	original, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer original.Close()
+
+	ns, err := netns.NewNamed(name)
+	if err == nil {
+		ns.Close()
+		undo.record(action{Kind: actionNamespace, Namespace: name, Device: device})
+	}
+	setErr := netns.Set(original)
+	if setErr != nil {
+		return setErr
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+// deleteNamespace deletes the tunnel's link inside the named namespace,
+// or every link of the daemon's there when device is empty, then the
+// namespace and its DNS configuration. The namespace itself only goes away
+// once the last process in it exits, but without the link it has no way
+// out.
+func deleteNamespace(name string, device string) error {
+	if _, err := os.Stat(filepath.Join(NETNS_RUN_DIR, name)); os.IsNotExist(err) {
+		return nil
+	}
+
+	ns, err := netns.GetFromName(name)
+	if err != nil {
+		return err
+	}
+	handle, err := netlink.NewHandleAt(ns)
+	ns.Close()
+	if err != nil {
+		return err
+	}
+	defer handle.Delete()
+	links, err := handle.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if name != device && (len(device) > 0 || link.Type() != "wireguard" || !strings.HasPrefix(name, DEVICE_PREFIX)) {
+			continue
+		}
+		err = handle.LinkDel(link)
+		if err != nil && !isNotExist(err) {
+			return err
+		}
+	}
+
+	err = os.RemoveAll(filepath.Join(NETNS_ETC_DIR, name))
+	if err != nil {
+		return err
+	}
+	return netns.DeleteNamed(name)
+}
+
+// configureNamespace moves the tunnel's link into a namespace of its own and
+// sets it up there, as the namespace's only way out. The link keeps its UDP
+// socket in the host's namespace, so the tunnel itself still uses the
+// host's network.
+func configureNamespace(configData types.ConfigData, state *tunnelState, device netlink.Link, addresses []*netlink.Addr, routedNets []netip.Prefix) error {
+	undo := &state.Undo
+
+	err := createNamespace(undo, NETNS_NAME, state.Device)
+	if err != nil {
+		return newError(types.ErrInternal, "error creating network namespace", err)
+	}
+	state.Namespace = NETNS_NAME
+
+	ns, err := netns.GetFromName(NETNS_NAME)
+	if err != nil {
+		return newError(types.ErrInternal, "error opening network namespace", err)
+	}
+	defer ns.Close()
+	err = netlink.LinkSetNsFd(device, int(ns))
+	if err != nil {
+		return newError(types.ErrInternal, "error moving link to network namespace", err)
+	}
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return newError(types.ErrInternal, "error opening network namespace", err)
+	}
+	defer handle.Delete()
+
+	lo, err := handle.LinkByName("lo")
+	if err == nil {
+		err = handle.LinkSetUp(lo)
+	}
+	if err != nil {
+		return newError(types.ErrInternal, "error setting up loopback", err)
+	}
+
+	link, err := handle.LinkByName(state.Device)
+	if err != nil {
+		return newError(types.ErrLinkNotFound, "error finding link in network namespace", err)
+	}
+	for _, address := range addresses {
+		err = handle.AddrReplace(link, address)
+		if err != nil {
+			return newError(types.ErrInternal, "error setting ip address", err)
+		}
+	}
+	err = handle.LinkSetUp(link)
+	if err != nil {
+		return newError(types.ErrInternal, "error setting up device", err)
+	}
+
+	// Nothing else in the namespace can reach anything, so the routes go
+	// straight into its main table
+	for _, routedNet := range routedNets {
+		dst, err := netlink.ParseIPNet(routedNet.String())
+		if err != nil {
+			return newError(types.ErrInternal, "error parsing route destination", err)
+		}
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK, Table: unix.RT_TABLE_MAIN}
+		err = handle.RouteReplace(route)
+		if err != nil {
+			return newError(types.ErrInternal, "error adding new route", err)
+		}
+	}
+
+	if len(configData.DNSServers) > 0 {
+		spec := &dnsSpec{Device: state.Device, Servers: configData.DNSServers, Domains: configData.SearchDomains}
+		err = writeNamespaceResolvConf(NETNS_NAME, spec)
+		if err != nil {
+			return newError(types.ErrInternal, "error writing namespace resolv.conf", err)
+		}
+	}
+	return nil
+}
+
+// writeNamespaceResolvConf writes the resolv.conf that processes started in
+// the namespace see, where "ip netns exec" looks for it too.
+func writeNamespaceResolvConf(name string, spec *dnsSpec) error {
+	dir := filepath.Join(NETNS_ETC_DIR, name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	return replaceFile(filepath.Join(dir, "resolv.conf"), resolvConfContent(spec), 0644)
+}
+
+// namespaceLinkExists reports whether the device is in the named namespace.
+func namespaceLinkExists(name string, device string) bool {
+	ns, err := netns.GetFromName(name)
+	if err != nil {
+		return false
+	}
+	defer ns.Close()
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return false
+	}
+	defer handle.Delete()
+	_, err = handle.LinkByName(device)
+	return err == nil
+}
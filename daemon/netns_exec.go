@@ -0,0 +1,272 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+// ExecInNamespace runs a command in the namespace of a namespaced tunnel as
+// the calling user, with the standard streams the caller passed along with
+// the call, the caller's working directory and the given environment, and
+// returns once the command exits. Like application policies this needs a
+// known caller, so only the Unix socket is served.
+func (l *Listener) ExecInNamespace(data types.NamespaceExecData, reply *types.NamespaceExecReply) error {
+	if l.peer == nil {
+		return newError(types.ErrInternal, "running commands in the namespace needs a connection on the Unix socket", nil)
+	}
+	streams := l.takeStreams()
+	for _, f := range streams {
+		defer f.Close()
+	}
+	if len(streams) != MAX_PASSED_FILES {
+		return newError(types.ErrInvalidConfig, "the command's standard streams were not passed along", nil)
+	}
+	if len(data.Args) == 0 {
+		return newError(types.ErrInvalidConfig, "no command to run", nil)
+	}
+
+	tunnelLock.Lock()
+	namespace := ""
+	if state := tunnelWith(actionNamespace, ""); state != nil {
+		namespace = state.Namespace
+	}
+	tunnelLock.Unlock()
+	if len(namespace) == 0 {
+		return newError(types.ErrNotConnected, "no namespaced tunnel is up", nil)
+	}
+
+	cmd, err := namespaceCommand(namespace, l.peer, data.Args, streams)
+	if err != nil {
+		return logError("ExecInNamespace", newError(types.ErrInternal, "error preparing command", err))
+	}
+
+	l.lock.Lock()
+	if l.command != nil {
+		l.lock.Unlock()
+		return newError(types.ErrInternal, "a command is already running for this connection", nil)
+	}
+	envReader, envWriter, err := os.Pipe()
+	if err != nil {
+		l.lock.Unlock()
+		return logError("ExecInNamespace", newError(types.ErrInternal, "error preparing command", err))
+	}
+	cmd.ExtraFiles = []*os.File{envReader}
+	err = inNamespace(namespace, cmd.Start)
+	envReader.Close()
+	if err != nil {
+		envWriter.Close()
+		l.lock.Unlock()
+		return logError("ExecInNamespace", newError(types.ErrInternal, "error starting command", err))
+	}
+	l.command = cmd.Process
+	l.lock.Unlock()
+	go writeEnvironment(envWriter, data.Env)
+
+	log.Printf("process %d (uid %d) runs %q in network namespace %s", l.peer.Pid, l.peer.Uid, data.Args[0], namespace)
+	err = cmd.Wait()
+
+	l.lock.Lock()
+	l.command = nil
+	l.lock.Unlock()
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return logError("ExecInNamespace", newError(types.ErrInternal, "error waiting for command", err))
+	}
+	reply.ExitCode = exitCode(cmd.ProcessState)
+	return nil
+}
+
+// SignalNamespaceCommand sends a signal to the command this connection is
+// running in the namespace, which does not share the caller's terminal
+// session.
+func (l *Listener) SignalNamespaceCommand(data types.NamespaceSignalData, reply *types.Reply) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.command == nil {
+		return newError(types.ErrInternal, "no command is running for this connection", nil)
+	}
+	err := l.command.Signal(syscall.Signal(data.Signal))
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return newError(types.ErrInternal, "error sending signal", err)
+	}
+	return nil
+}
+
+// namespaceCommand prepares the nsexec helper for the command. The helper
+// starts as root in a mount namespace of its own, so that it can put the
+// namespace's resolv.conf in place before it becomes the caller. While it
+// is root it runs with an empty environment; the caller's is written to the
+// pipe that becomes its fourth file, and only the command gets it.
+func namespaceCommand(namespace string, peer *unix.Ucred, command []string, streams []*os.File) (*exec.Cmd, error) {
+	groups, err := processGroups(int(peer.Pid))
+	if err != nil {
+		return nil, err
+	}
+	var groupList []string
+	for _, group := range groups {
+		groupList = append(groupList, strconv.Itoa(group))
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"nsexec", namespace,
+		strconv.Itoa(int(peer.Uid)), strconv.Itoa(int(peer.Gid)), strings.Join(groupList, ","),
+		"--"}
+	cmd := exec.Command(self, append(args, command...)...)
+	cmd.Env = []string{}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:       true,
+		Unshareflags: syscall.CLONE_NEWNS,
+	}
+
+	cmd.Dir, err = os.Readlink(fmt.Sprintf("/proc/%d/cwd", peer.Pid))
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = streams[0], streams[1], streams[2]
+	return cmd, nil
+}
+
+// writeEnvironment writes the environment for the nsexec helper, separated
+// by NUL bytes, and closes the pipe.
+func writeEnvironment(pipe *os.File, env []string) {
+	_, err := pipe.Write([]byte(strings.Join(env, "\x00")))
+	if err != nil {
+		log.Print("error passing the environment to the command: ", err)
+	}
+	pipe.Close()
+}
+
+// readEnvironment reads the environment written by writeEnvironment.
+func readEnvironment(pipe *os.File) ([]string, error) {
+	defer pipe.Close()
+	data, err := io.ReadAll(pipe)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	return strings.Split(string(data), "\x00"), nil
+}
+
+// exitCode returns the exit code of a process the way a shell reports it,
+// with 128 plus the signal for processes killed by a signal.
+func exitCode(state *os.ProcessState) int {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// nsexec is the helper that runs a command in a namespace. It is started as
+// root in the namespace and a private mount namespace, bind mounts the
+// namespace's resolv.conf over the system's, drops to the caller's
+// credentials and executes the command with the environment it reads from
+// its fourth file.
+//
+//	wbd nsexec <namespace> <uid> <gid> <groups> -- <command> [<args>]
+func nsexec(args []string) error {
+	if len(args) < 6 || args[4] != "--" {
+		return fmt.Errorf("usage: wbd nsexec <namespace> <uid> <gid> <groups> -- <command> [<args>]")
+	}
+	uid, err := strconv.Atoi(args[1])
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(args[2])
+	if err != nil {
+		return err
+	}
+	var groups []int
+	for _, field := range splitList(args[3]) {
+		group, err := strconv.Atoi(field)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, group)
+	}
+	command := args[5:]
+	env, err := readEnvironment(os.NewFile(3, "environment"))
+	if err != nil {
+		return fmt.Errorf("error reading environment: %w", err)
+	}
+
+	resolvConf := filepath.Join(NETNS_ETC_DIR, args[0], "resolv.conf")
+	_, err = os.Stat(resolvConf)
+	if err == nil {
+		err = unix.Mount(resolvConf, resolvConfPath, "none", unix.MS_BIND, "")
+		if err != nil {
+			return fmt.Errorf("error mounting %s: %w", resolvConf, err)
+		}
+	}
+
+	err = syscall.Setgroups(groups)
+	if err != nil {
+		return err
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return err
+	}
+	err = syscall.Setuid(uid)
+	if err != nil {
+		return err
+	}
+
+	// The command is looked up on the caller's PATH
+	os.Clearenv()
+	for _, variable := range env {
+		key, value, ok := strings.Cut(variable, "=")
+		if ok {
+			os.Setenv(key, value)
+		}
+	}
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, command, env)
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
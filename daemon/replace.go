@@ -0,0 +1,247 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// replaceTunnel turns the tunnel of state into the one described by
+// configData, in place. The tunnel keeps its device, routing table, mark
+// and whatever rules it still needs, and the old server's peer is swapped
+// for the new one in a single step, so that no traffic leaves outside the
+// tunnel while the server changes. Only what differs is changed, so
+// replacing a tunnel with the same configuration changes nothing.
+func replaceTunnel(configData types.ConfigData, state *tunnelState) error {
+	undo := &state.Undo
+
+	// The namespace and the forwarder are set up around the tunnel's
+	// addresses and ranges, these tunnels are brought up again instead
+	if len(state.Namespace) > 0 || configData.Namespace || len(state.TunnelDomains) > 0 || len(configData.TunnelDomains) > 0 {
+		return newError(types.ErrInvalidConfig, "namespaced tunnels and tunnels of domains cannot be replaced, disconnect first", nil)
+	}
+	if configData.AppsOnly != state.AppsOnly {
+		return newError(types.ErrInvalidConfig, "a tunnel cannot change whether it is just for applications, disconnect first", nil)
+	}
+
+	routedNets, err := tunnelRanges(configData)
+	if err != nil {
+		return err
+	}
+	allowedNets, err := allowedRanges(configData, routedNets)
+	if err != nil {
+		return err
+	}
+	peer, err := serverPeer(configData, allowedNets)
+	if err != nil {
+		return err
+	}
+	clientPrivateKey, err := wgtypes.ParseKey(configData.ClientPrivateKey)
+	if err != nil {
+		return newError(types.ErrInvalidKey, "error parsing private key", err)
+	}
+	clientAddresses, addresses, err := clientAddrs(configData)
+	if err != nil {
+		return err
+	}
+	var blockedNets []netip.Prefix
+	if config.IPv6LeakProtection != ipv6PolicyOff {
+		blockedNets = leakRanges(configData)
+	}
+
+	device, err := netlink.LinkByName(state.Device)
+	if err != nil {
+		return newError(types.ErrLinkNotFound, fmt.Sprintf("error finding link %s", state.Device), err)
+	}
+
+	// The new addresses go on before the old ones come off, so that the
+	// tunnel always has an address
+	for i, address := range addresses {
+		err = netlink.AddrReplace(device, address)
+		if err != nil {
+			return newError(types.ErrInternal, "error setting ip address", err)
+		}
+		if !state.hasAction(func(a action) bool { return a.Kind == actionAddress && a.Address == clientAddresses[i] }) {
+			undo.record(action{Kind: actionAddress, Device: state.Device, Address: clientAddresses[i]})
+		}
+	}
+
+	// Let the new server through the kill switch before talking to it
+	killSwitch := configData.KillSwitch || config.KillSwitch
+	if killSwitch {
+		spec := &killSwitchSpec{
+			Device:        state.Device,
+			ServerAddress: configData.ServerAddress,
+			ServerPort:    configData.ServerPort,
+			FirewallMark:  state.FirewallMark,
+			Bypass:        configData.ExcludeRanges,
+		}
+		err = enableKillSwitch(spec)
+		if err != nil {
+			return err
+		}
+		replaced := false
+		for i := range undo.Actions {
+			if undo.Actions[i].Kind == actionKillSwitch {
+				undo.Actions[i].KillSwitch = spec
+				replaced = true
+			}
+		}
+		if !replaced {
+			undo.record(action{Kind: actionKillSwitch, KillSwitch: spec})
+		}
+	}
+
+	// Swap the peers in one go
+	cfg := wgtypes.Config{
+		PrivateKey:   &clientPrivateKey,
+		Peers:        []wgtypes.PeerConfig{peer},
+		ReplacePeers: true,
+	}
+	c, err := wgctrl.New()
+	if err != nil {
+		return newError(types.ErrInternal, "error getting new wireguard client", err)
+	}
+	defer c.Close()
+	err = c.ConfigureDevice(state.Device, cfg)
+	if err != nil {
+		return newError(types.ErrInternal, fmt.Sprintf("error configuring device %s", state.Device), err)
+	}
+	state.ServerName = configData.ServerName
+	state.ServerAddress = configData.ServerAddress
+	state.ServerPort = configData.ServerPort
+	state.PersistentKeepalive = configData.PersistentKeepalive
+	state.ClientAddress = configData.ClientAddress
+	state.ClientAddress6 = configData.ClientAddress6
+	state.IncludeRanges = configData.IncludeRanges
+	state.ExcludeRanges = configData.ExcludeRanges
+
+	// Routes and rules the new ranges need, then away with the ones they
+	// do not
+	var routes []routeSpec
+	for _, routedNet := range routedNets {
+		spec := routeSpec{Dst: routedNet.String(), Device: state.Device, Table: state.Table}
+		routes = append(routes, spec)
+		if !state.hasAction(func(a action) bool { return a.Kind == actionRoute && *a.Route == spec }) {
+			err = configureIpRoutes(undo, device, state.Table, spec.Dst)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	state.IPv6Policy = ""
+	for _, blockedNet := range blockedNets {
+		spec := blockRouteSpec(state.Table, blockedNet.String(), config.IPv6LeakProtection)
+		routes = append(routes, spec)
+		if !state.hasAction(func(a action) bool { return a.Kind == actionRoute && *a.Route == spec }) {
+			err = blockIpRoutes(undo, state.Table, spec.Dst, config.IPv6LeakProtection)
+			if err != nil {
+				return err
+			}
+		}
+		state.IPv6Policy = config.IPv6LeakProtection
+	}
+
+	rules := tunnelRules(state, allowedNets, blockedNets)
+	var missingRules []ruleSpec
+	for _, spec := range rules {
+		spec := spec
+		if !state.hasAction(func(a action) bool { return a.Kind == actionRule && *a.Rule == spec }) {
+			missingRules = append(missingRules, spec)
+		}
+	}
+	err = configureIpRules(undo, missingRules)
+	if err != nil {
+		return err
+	}
+
+	err = undo.rollbackWhere(func(a action) bool {
+		switch a.Kind {
+		case actionAddress:
+			return !containsString(clientAddresses, a.Address)
+		case actionRoute:
+			return !containsRoute(routes, *a.Route)
+		case actionRule:
+			return !containsRule(rules, *a.Rule) && !isAppAction(a) && !isEndpointRule(a)
+		case actionKillSwitch:
+			return !killSwitch
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	// The new servers take over DNS without the system's resolver getting
+	// a turn in between
+	for _, a := range undo.Actions {
+		if a.Kind == actionDNS && len(configData.DNSServers) > 0 {
+			return updateDNS(a.DNS, configData.DNSServers, configData.SearchDomains)
+		}
+	}
+	if len(configData.DNSServers) > 0 {
+		return configureDNS(undo, state.Device, configData.DNSServers, configData.SearchDomains)
+	}
+	return undo.rollbackWhere(func(a action) bool {
+		return a.Kind == actionDNS
+	})
+}
+
+// hasAction reports whether the tunnel's undo log has a matching action.
+func (s *tunnelState) hasAction(match func(a action) bool) bool {
+	for _, a := range s.Undo.Actions {
+		if match(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(arr []string, str string) bool {
+	for _, a := range arr {
+		if a == str {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRoute(specs []routeSpec, spec routeSpec) bool {
+	for _, s := range specs {
+		if s == spec {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRule(specs []ruleSpec, spec ruleSpec) bool {
+	for _, s := range specs {
+		if s == spec {
+			return true
+		}
+	}
+	return false
+}
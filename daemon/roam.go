@@ -0,0 +1,256 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+// How long the network has to settle after a change before the tunnels
+// roam, so that a burst of updates is handled once
+const ROAM_SETTLE_TIME = 1 * time.Second
+
+// watchNetwork follows the system's links, addresses and routes for as long
+// as the daemon runs, and has the tunnels roam whenever the network they
+// run over changes, such as when moving from Wi-Fi to Ethernet.
+func watchNetwork() {
+	watch, err := subscribeNetwork()
+	if err != nil {
+		log.Print("error subscribing to network changes, tunnels will not roam: ", err)
+		return
+	}
+	defer watch.close()
+	watch.follow(roamAll)
+	log.Print("subscription to network changes ended, tunnels will not roam")
+}
+
+// networkWatch is a subscription to the changes of the links, addresses and
+// routes of the network namespace it was made in, and the underlying network
+// as it was when the changes were last handled.
+type networkWatch struct {
+	underlying   string
+	done         chan struct{}
+	linkUpdates  chan netlink.LinkUpdate
+	addrUpdates  chan netlink.AddrUpdate
+	routeUpdates chan netlink.RouteUpdate
+}
+
+// subscribeNetwork subscribes to the changes of the network namespace of the
+// calling thread, starting from the underlying network as it is now.
+func subscribeNetwork() (*networkWatch, error) {
+	watch := &networkWatch{
+		done:         make(chan struct{}),
+		linkUpdates:  make(chan netlink.LinkUpdate, 64),
+		addrUpdates:  make(chan netlink.AddrUpdate, 64),
+		routeUpdates: make(chan netlink.RouteUpdate, 64),
+	}
+	err := netlink.LinkSubscribe(watch.linkUpdates, watch.done)
+	if err == nil {
+		err = netlink.AddrSubscribe(watch.addrUpdates, watch.done)
+	}
+	if err == nil {
+		err = netlink.RouteSubscribe(watch.routeUpdates, watch.done)
+	}
+	if err != nil {
+		watch.close()
+		return nil, err
+	}
+	watch.underlying, err = underlyingNetwork()
+	if err != nil {
+		log.Print(err)
+	}
+	return watch, nil
+}
+
+// close ends the subscription, which makes follow return.
+func (watch *networkWatch) close() {
+	close(watch.done)
+}
+
+// follow calls onChange whenever the underlying network has changed and
+// settled, until the subscription ends.
+func (watch *networkWatch) follow(onChange func(now time.Time)) {
+	var settle <-chan time.Time
+	for {
+		ok := true
+		select {
+		case _, ok = <-watch.linkUpdates:
+		case _, ok = <-watch.addrUpdates:
+		case _, ok = <-watch.routeUpdates:
+		case <-watch.done:
+			return
+		case <-settle:
+			settle = nil
+			current, err := underlyingNetwork()
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			if current == watch.underlying {
+				continue
+			}
+			watch.underlying = current
+			log.Print("the network changed, roaming")
+			onChange(time.Now())
+			continue
+		}
+		if !ok {
+			return
+		}
+		if settle == nil {
+			settle = time.After(ROAM_SETTLE_TIME)
+		}
+	}
+}
+
+// underlyingNetwork describes the default routes of the main table, which
+// the tunnels' packets take, and the addresses of their links. Two
+// descriptions differ when the tunnels have to roam.
+func underlyingNetwork() (string, error) {
+	var lines []string
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		filter := &netlink.Route{Table: unix.RT_TABLE_MAIN}
+		routes, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return "", newError(types.ErrInternal, "error listing routes", err)
+		}
+		for _, route := range routes {
+			if len(netString(route.Dst)) > 0 {
+				continue
+			}
+			link, err := netlink.LinkByIndex(route.LinkIndex)
+			if err != nil {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("default via %s dev %s src %s metric %d", route.Gw, link.Attrs().Name, route.Src, route.Priority))
+			addrs, err := netlink.AddrList(link, family)
+			if err != nil {
+				return "", newError(types.ErrInternal, "error listing addresses", err)
+			}
+			for _, addr := range addrs {
+				if addr.Scope == unix.RT_SCOPE_UNIVERSE {
+					lines = append(lines, fmt.Sprintf("address %s dev %s", addr.IPNet, link.Attrs().Name))
+				}
+			}
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), nil
+}
+
+// roamAll has every tunnel roam.
+func roamAll(now time.Time) {
+	tunnelLock.Lock()
+	defer tunnelLock.Unlock()
+	for _, state := range sortedTunnels() {
+		err := roam(state, now)
+		if err != nil {
+			log.Printf("error roaming tunnel %s: %v", state.Device, err)
+			emitEvent(types.EventError, state.Device, state.ServerName, types.ParseRPCError(err).Message)
+		}
+	}
+}
+
+// roam moves the tunnel over to the network the system is on now. The
+// tunnel's peer is renewed, which starts a new handshake from the new
+// network, and its rules and routes are put back if the change took any of
+// them away.
+func roam(state *tunnelState, now time.Time) error {
+	state.setConnState(types.StateConnecting)
+	err := renewPeer(state, now)
+	rulesErr := restoreRules(state)
+	if err == nil {
+		err = rulesErr
+	}
+	return err
+}
+
+// restoreRules adds the rules and routes the tunnel's undo log records
+// that are missing from the system. Without its rules a tunnel's traffic
+// takes the main table, and without the rule that suppresses the main
+// table's default route it bypasses the tunnel.
+func restoreRules(state *tunnelState) error {
+	// A namespaced tunnel's routes went with its link into the namespace
+	if len(state.Namespace) > 0 {
+		return nil
+	}
+
+	var firstErr error
+	for _, a := range state.Undo.Actions {
+		var err error
+		switch a.Kind {
+		case actionRule:
+			err = restoreRule(a.Rule)
+		case actionRoute:
+			err = restoreRoute(a.Route)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func restoreRule(spec *ruleSpec) error {
+	rule, err := spec.netlinkRule()
+	if err != nil {
+		return newError(types.ErrInternal, "error parsing rule", err)
+	}
+	family := ipFamily(rule.Src.IP)
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		return newError(types.ErrInternal, "error listing rules", err)
+	}
+	for _, existing := range rules {
+		if matchesAnyRule(existing, family, []ruleSpec{*spec}) {
+			return nil
+		}
+	}
+	log.Printf("restoring rule %s", rule)
+	err = netlink.RuleAdd(rule)
+	if err != nil {
+		return newError(types.ErrRuleConflict, "error restoring rule", err)
+	}
+	return nil
+}
+
+func restoreRoute(spec *routeSpec) error {
+	route, err := spec.netlinkRoute()
+	if err != nil {
+		return newError(types.ErrInternal, "error parsing route", err)
+	}
+	err = netlink.RouteAdd(route)
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	if err != nil {
+		return newError(types.ErrInternal, "error restoring route", err)
+	}
+	log.Printf("restored route %s", route)
+	return nil
+}
@@ -0,0 +1,219 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeWireguard answers the userspace configuration protocol on a device's
+// socket, with a single peer, and keeps the configuration it is sent.
+type fakeWireguard struct {
+	peer wgtypes.Key
+
+	lock sync.Mutex
+	sets []string
+}
+
+func serveFakeWireguard(t *testing.T, device string) *fakeWireguard {
+	path := filepath.Join("/var/run/wireguard", device+".sock")
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		t.Skipf("wireguard device %s exists", device)
+	}
+	os.Remove(path)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeWireguard{peer: key.PublicKey()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fake.serve(conn)
+		}
+	}()
+	return fake
+}
+
+func (fake *fakeWireguard) serve(conn net.Conn) {
+	defer conn.Close()
+	var lines []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() && len(scanner.Text()) > 0 {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) == 0 {
+		return
+	}
+	if lines[0] == "get=1" {
+		fmt.Fprintf(conn, "public_key=%s\nallowed_ip=0.0.0.0/0\nerrno=0\n\n", hex.EncodeToString(fake.peer[:]))
+		return
+	}
+	fake.lock.Lock()
+	fake.sets = append(fake.sets, strings.Join(lines[1:], "\n"))
+	fake.lock.Unlock()
+	fmt.Fprint(conn, "errno=0\n\n")
+}
+
+func (fake *fakeWireguard) configured() []string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return append([]string(nil), fake.sets...)
+}
+
+// TestRoaming follows the network while the default route moves from one
+// link to another, with a tunnel for everything on wb0 whose rule that
+// suppresses the main table's default route went missing.
+func TestRoaming(t *testing.T) {
+	enterTestNamespace(t, "wb0")
+	wireguard := serveFakeWireguard(t, "wb0")
+	for _, name := range []string{"eth0", "eth1"} {
+		mustNetlink(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}))
+		peer, err := netlink.LinkByName(name + "p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustNetlink(t, netlink.LinkSetUp(peer))
+	}
+	addAddress(t, "eth0", "192.168.1.2/24")
+	addAddress(t, "eth1", "192.168.2.2/24")
+	addAddress(t, "wb0", "10.64.0.2/32")
+	mustNetlink(t, netlink.RouteAdd(&netlink.Route{Gw: net.ParseIP("192.168.1.1")}))
+
+	tunnel := fullTunnel("wb0", 0x57420100)
+	state := tunnel.state
+	state.ServerAddress = "203.0.113.1"
+	state.ServerPort = 51820
+	link, err := netlink.LinkByName(state.Device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = configureIpRoutes(&state.Undo, link, state.Table, ALL_NETWORK_RANGE)
+	if err == nil {
+		err = configureIpRules(&state.Undo, tunnel.rules())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { state.Undo.rollback() })
+
+	tunnelLock.Lock()
+	tunnels[state.Device] = state
+	tunnelLock.Unlock()
+	t.Cleanup(func() {
+		tunnelLock.Lock()
+		delete(tunnels, state.Device)
+		tunnelLock.Unlock()
+	})
+
+	var suppress ruleSpec
+	for _, rule := range tunnel.rules() {
+		if rule.SuppressPrefixlen == 0 {
+			suppress = rule
+		}
+	}
+	rule, err := suppress.netlinkRule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustNetlink(t, netlink.RuleDel(rule))
+
+	// The watch is made in the test's namespace and follows it from there
+	watch, err := subscribeNetwork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roamed := make(chan time.Time, 8)
+	stopped := goInTestNamespace(t, func() {
+		watch.follow(func(now time.Time) {
+			roamAll(now)
+			roamed <- now
+		})
+	})
+	defer func() {
+		watch.close()
+		<-stopped
+	}()
+
+	// The default route goes away for a moment, which the settling hides
+	mustNetlink(t, netlink.RouteDel(&netlink.Route{Gw: net.ParseIP("192.168.1.1")}))
+	time.Sleep(ROAM_SETTLE_TIME / 4)
+	mustNetlink(t, netlink.RouteAdd(&netlink.Route{Gw: net.ParseIP("192.168.2.1")}))
+	select {
+	case <-roamed:
+	case <-time.After(5 * ROAM_SETTLE_TIME):
+		t.Fatal("the tunnels did not roam after the default route moved")
+	}
+
+	sets := wireguard.configured()
+	endpoint := "endpoint=203.0.113.1:51820"
+	if len(sets) != 2 || !strings.Contains(sets[0], "remove=true") || !strings.Contains(sets[1], endpoint) {
+		t.Errorf("peer configured with %q, want it removed and added back with %s", sets, endpoint)
+	}
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := false
+	for _, existing := range rules {
+		restored = restored || matchesAnyRule(existing, netlink.FAMILY_V4, []ruleSpec{suppress})
+	}
+	if !restored {
+		t.Error("the rule suppressing the main table's default route was not restored")
+	}
+
+	// Changes to the tunnels' own tables are no reason to roam
+	_, all, err := net.ParseCIDR(ALL_NETWORK_RANGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustNetlink(t, netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: all, Table: state.Table, Priority: 10}))
+	select {
+	case <-roamed:
+		t.Error("the tunnels roamed more than once")
+	case <-time.After(3 * ROAM_SETTLE_TIME):
+	}
+}
@@ -0,0 +1,173 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/whiteboxvpn/cli/types"
+)
+
+const LOGIND_BUS_NAME = "org.freedesktop.login1"
+const LOGIND_OBJECT_PATH = "/org/freedesktop/login1"
+const LOGIND_MANAGER = "org.freedesktop.login1.Manager"
+
+// How far the wall clock has to run ahead of the monotonic clock between
+// two looks of the monitor for the system to have slept
+const SLEEP_DETECT_THRESHOLD = 10 * time.Second
+
+// Logind and the clock both tell about the same resume, only the first
+// one within RESUME_GRACE renews the tunnels.
+const RESUME_GRACE = 30 * time.Second
+
+// suspended holds the configuration of the tunnels taken down for sleep,
+// and lastResume when the tunnels were last renewed after it.
+var suspended []types.ConfigData
+var lastResume time.Time
+
+// watchSleep follows logind's PrepareForSleep signal, for as long as the
+// daemon runs. With the "disconnect" sleep policy the daemon holds a delay
+// lock, which makes logind wait with sleep until the tunnels are down.
+// Without logind a resume is only noticed from the clock.
+func watchSleep() {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		log.Print("error connecting to the system bus, resume is only noticed from the clock: ", err)
+		return
+	}
+	err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(LOGIND_OBJECT_PATH),
+		dbus.WithMatchInterface(LOGIND_MANAGER),
+		dbus.WithMatchMember("PrepareForSleep"),
+	)
+	if err != nil {
+		conn.Close()
+		log.Print("error watching for sleep, resume is only noticed from the clock: ", err)
+		return
+	}
+	signals := make(chan *dbus.Signal, 8)
+	conn.Signal(signals)
+
+	sleepLock := takeSleepLock(conn)
+	for signal := range signals {
+		if signal.Name != LOGIND_MANAGER+".PrepareForSleep" || len(signal.Body) != 1 {
+			continue
+		}
+		sleeping, ok := signal.Body[0].(bool)
+		if !ok {
+			continue
+		}
+		if sleeping {
+			suspendTunnels()
+			if sleepLock != nil {
+				sleepLock.Close()
+				sleepLock = nil
+			}
+		} else {
+			resumed(time.Now())
+			sleepLock = takeSleepLock(conn)
+		}
+	}
+	log.Print("lost the system bus, resume is only noticed from the clock")
+}
+
+// takeSleepLock takes logind's delay lock for sleep when the tunnels are to
+// be taken down before it. Closing the file releases the lock.
+func takeSleepLock(conn *dbus.Conn) *os.File {
+	if config.SleepPolicy != sleepPolicyDisconnect {
+		return nil
+	}
+	var fd dbus.UnixFD
+	err := conn.Object(LOGIND_BUS_NAME, LOGIND_OBJECT_PATH).Call(LOGIND_MANAGER+".Inhibit", 0,
+		"sleep", "White Box VPN", "Disconnecting the VPN", "delay").Store(&fd)
+	if err != nil {
+		log.Print("error taking the sleep lock, tunnels may stay up during sleep: ", err)
+		return nil
+	}
+	return os.NewFile(uintptr(fd), "sleep lock")
+}
+
+// suspendTunnels takes the tunnels down for sleep, if the sleep policy says
+// so. Tunnels with a kill switch stay up, and so do tunnels whose state
+// file does not hold the configuration to bring them up again.
+func suspendTunnels() {
+	if config.SleepPolicy != sleepPolicyDisconnect {
+		return
+	}
+	tunnelLock.Lock()
+	defer tunnelLock.Unlock()
+
+	for _, state := range sortedTunnels() {
+		if state.killSwitchEnabled() || len(state.Config.ClientPrivateKey) == 0 {
+			continue
+		}
+		handOverAppMarks(state, sortedTunnels())
+		err := state.Undo.rollback()
+		if err != nil {
+			log.Printf("error taking tunnel %s down for sleep: %v", state.Device, err)
+			saveErr := saveState(state)
+			if saveErr != nil {
+				log.Print("error saving tunnel state: ", saveErr)
+			}
+			continue
+		}
+		dropTunnel(state)
+		suspended = append(suspended, state.Config)
+		log.Printf("took tunnel %s to %s down for sleep", state.Device, state.ServerName)
+	}
+}
+
+// resumed brings the tunnels back after the system woke up. Their sessions
+// have most likely expired, and waiting for wireguard to notice can take
+// minutes, so every tunnel renews its peer straight away. Tunnels taken
+// down for sleep are brought up again.
+func resumed(now time.Time) {
+	tunnelLock.Lock()
+	defer tunnelLock.Unlock()
+
+	// By the wall clock, which counts the time asleep
+	if lastResume.IsZero() || now.Round(0).Sub(lastResume) > RESUME_GRACE {
+		lastResume = now.Round(0)
+		log.Print("the system resumed, renewing tunnels")
+		for _, state := range sortedTunnels() {
+			err := roam(state, now)
+			if err != nil {
+				log.Printf("error renewing tunnel %s: %v", state.Device, err)
+				emitEvent(types.EventError, state.Device, state.ServerName, types.ParseRPCError(err).Message)
+			}
+		}
+	}
+
+	for _, configData := range suspended {
+		if findTunnel(configData.ServerName) != nil {
+			continue
+		}
+		state, err := bringUp(configData)
+		if err != nil {
+			log.Printf("error bringing the tunnel to %s back up: %v", configData.ServerName, err)
+			emitEvent(types.EventError, "", configData.ServerName, types.ParseRPCError(err).Message)
+			continue
+		}
+		log.Printf("brought the tunnel to %s back up as tunnel %s", state.ServerName, state.Device)
+	}
+	suspended = nil
+}
@@ -0,0 +1,243 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const DEFAULT_SOCKET_PATH = "/run/whitebox/wbd.sock"
+const DEFAULT_SOCKET_GROUP = "whitebox"
+
+// listenUnix creates the Unix domain socket the daemon serves its RPC API
+// on. The socket is owned by root and the given group (when gid is not -1)
+// and is not accessible to anybody else.
+func listenUnix(path string, gid int) (*net.UnixListener, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the socket left behind by a previous run
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	oldMask := syscall.Umask(0177)
+	inbound, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+
+	if gid >= 0 {
+		err = os.Chown(path, 0, gid)
+		if err == nil {
+			err = os.Chmod(path, 0660)
+		}
+		if err != nil {
+			inbound.Close()
+			return nil, err
+		}
+	}
+	return inbound, nil
+}
+
+// serveUnix accepts connections on the socket and serves the RPC API to
+// every peer that passes the credential check.
+func serveUnix(inbound *net.UnixListener, gid int) {
+	for {
+		conn, err := inbound.AcceptUnix()
+		if err != nil {
+			log.Print("error accepting connection: ", err)
+			continue
+		}
+
+		cred, err := peerCredentials(conn)
+		if err != nil {
+			log.Print("error reading peer credentials: ", err)
+			conn.Close()
+			continue
+		}
+		allowed, err := peerAllowed(cred, gid)
+		if err != nil {
+			log.Printf("error checking groups of pid %d: %v", cred.Pid, err)
+		}
+		if !allowed {
+			log.Printf("rejecting connection from uid %d (pid %d)", cred.Uid, cred.Pid)
+			conn.Close()
+			continue
+		}
+
+		listener := &Listener{peer: cred}
+		server := rpc.NewServer()
+		server.Register(listener)
+		go func() {
+			server.ServeConn(&rightsConn{UnixConn: conn, listener: listener})
+			for _, f := range listener.takeStreams() {
+				f.Close()
+			}
+		}()
+	}
+}
+
+// MAX_PASSED_FILES is how many files a client may pass along with its
+// calls, the standard streams of a command for ExecInNamespace.
+const MAX_PASSED_FILES = 3
+
+// rightsConn is a connection on the Unix socket that keeps the files the
+// client passes along with its calls for the connection's Listener.
+type rightsConn struct {
+	*net.UnixConn
+	listener *Listener
+}
+
+func (c *rightsConn) Read(p []byte) (int, error) {
+	oob := make([]byte, unix.CmsgSpace(4*MAX_PASSED_FILES))
+	n, oobn, _, _, err := c.ReadMsgUnix(p, oob)
+	if oobn > 0 {
+		c.listener.receiveFiles(oob[:oobn])
+	}
+	return n, err
+}
+
+// receiveFiles keeps the files in the control message for the command the
+// connection runs next. Files beyond the standard streams are closed.
+func (l *Listener) receiveFiles(oob []byte) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		log.Print("error reading passed files: ", err)
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, message := range messages {
+		fds, err := unix.ParseUnixRights(&message)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			f := os.NewFile(uintptr(fd), "passed file")
+			if len(l.streams) >= MAX_PASSED_FILES {
+				f.Close()
+				continue
+			}
+			l.streams = append(l.streams, f)
+		}
+	}
+}
+
+// takeStreams returns the standard streams the client passed, and forgets
+// them. They are the caller's to close.
+func (l *Listener) takeStreams() []*os.File {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	streams := l.streams
+	l.streams = nil
+	return streams
+}
+
+// peerCredentials returns the SO_PEERCRED credentials of the process on the
+// other end of the connection.
+func peerCredentials(conn *net.UnixConn) (*unix.Ucred, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// peerAllowed reports whether the peer may use the RPC API. Root is always
+// allowed; everybody else needs the socket group as its primary or one of
+// its supplementary groups.
+func peerAllowed(cred *unix.Ucred, gid int) (bool, error) {
+	if cred.Uid == 0 {
+		return true, nil
+	}
+	if gid < 0 {
+		return false, nil
+	}
+	if int(cred.Gid) == gid {
+		return true, nil
+	}
+
+	groups, err := processGroups(int(cred.Pid))
+	if err != nil {
+		return false, err
+	}
+	return contains(groups, gid), nil
+}
+
+// processGroups reads the supplementary groups of a process from
+// /proc/<pid>/status.
+func processGroups(pid int) ([]int, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var groups []int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			group, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups, scanner.Err()
+}
+
+func contains(arr []int, value int) bool {
+	for _, a := range arr {
+		if a == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+const DEFAULT_STATE_DIR = "/var/lib/whitebox"
+
+// stateDir is where the daemon keeps the state of the tunnels that are up,
+// so that it can still tear them down after a restart.
+var stateDir = DEFAULT_STATE_DIR
+
+// tunnelState is everything the daemon configured for a tunnel.
+type tunnelState struct {
+	ServerName     string   `json:"serverName"`
+	Device         string   `json:"device"`
+	ServerAddress  string   `json:"serverAddress"`
+	ServerPort     int      `json:"serverPort"`
+	ClientAddress  string   `json:"clientAddress"`
+	ClientAddress6 string   `json:"clientAddress6,omitempty"`
+	IPv6Policy     string   `json:"ipv6Policy,omitempty"`
+	IncludeRanges  []string `json:"includeRanges,omitempty"`
+	ExcludeRanges  []string `json:"excludeRanges,omitempty"`
+	TunnelDomains  []string `json:"tunnelDomains,omitempty"`
+	AppsOnly       bool     `json:"appsOnly,omitempty"`
+	Namespace      string   `json:"namespace,omitempty"`
+	Table          int      `json:"table"`
+	FirewallMark   int      `json:"firewallMark"`
+	Undo           undoLog  `json:"undo"`
+
+	// PersistentKeepalive is the keepalive interval in seconds, 0 for none
+	PersistentKeepalive int `json:"persistentKeepalive,omitempty"`
+
+	// Config is what the tunnel was brought up with, which brings it up
+	// again after sleep, also after a restart of the daemon. It holds the
+	// private key, which is why state files are only readable by root.
+	Config types.ConfigData `json:"config"`
+
+	// conn is the state of the connection as the monitor sees it
+	conn connection
+}
+
+// killSwitchEnabled reports whether the tunnel's kill switch is enabled.
+func (s *tunnelState) killSwitchEnabled() bool {
+	for _, a := range s.Undo.Actions {
+		if a.Kind == actionKillSwitch {
+			return true
+		}
+	}
+	return false
+}
+
+// stateFilePath is where the state of the tunnel on the device is kept.
+func stateFilePath(device string) string {
+	return filepath.Join(stateDir, "tunnels", device+".json")
+}
+
+// loadStates reads the persisted state of every tunnel that was up.
+func loadStates() ([]*tunnelState, error) {
+	var states []*tunnelState
+	paths, err := filepath.Glob(stateFilePath("*"))
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, path := range paths {
+		state, err := readState(path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		states = append(states, state)
+	}
+	return states, firstErr
+}
+
+func readState(path string) (*tunnelState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state tunnelState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// saveState atomically replaces the persisted state of the tunnel.
+func saveState(state *tunnelState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := stateFilePath(state.Device)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	// A tmp file left behind keeps its mode, and the state holds the
+	// tunnel's private key
+	err = os.Chmod(tmpPath, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// removeState deletes the persisted state of the tunnel.
+func removeState(state *tunnelState) error {
+	err := os.Remove(stateFilePath(state.Device))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/whiteboxvpn/cli/types"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Status reports the tunnels that are up, together with the live
+// statistics of their wireguard devices. A tunnel whose device is missing is
+// reported as disconnected rather than as an error.
+func (l *Listener) Status(data types.StatusData, reply *[]types.TunnelStatus) error {
+	tunnelLock.Lock()
+	defer tunnelLock.Unlock()
+
+	states := sortedTunnels()
+	if len(data.Name) > 0 {
+		state := findTunnel(data.Name)
+		if state == nil {
+			return newError(types.ErrNotConnected, fmt.Sprintf("no tunnel named %s is up", data.Name), nil)
+		}
+		states = []*tunnelState{state}
+	}
+
+	statuses := []types.TunnelStatus{}
+	for _, state := range states {
+		status, err := tunnelStatus(state)
+		if err != nil {
+			return logError("Status", err)
+		}
+		statuses = append(statuses, status)
+	}
+	*reply = statuses
+	return nil
+}
+
+// tunnelStatus reports on a single tunnel.
+func tunnelStatus(state *tunnelState) (types.TunnelStatus, error) {
+	status := types.TunnelStatus{
+		Device:         state.Device,
+		ServerName:     state.ServerName,
+		ClientAddress:  state.ClientAddress,
+		ClientAddress6: state.ClientAddress6,
+		IPv6Policy:     state.IPv6Policy,
+		IncludeRanges:  state.IncludeRanges,
+		ExcludeRanges:  state.ExcludeRanges,
+		TunnelDomains:  state.TunnelDomains,
+		AppsOnly:       state.AppsOnly,
+		Namespace:      state.Namespace,
+		KillSwitch:     state.killSwitchEnabled(),
+		State:          state.conn.state,
+		Keepalive:      state.PersistentKeepalive,
+	}
+
+	var device *wgtypes.Device
+	err := withWireguard(state, func(c *wgctrl.Client) error {
+		var err error
+		device, err = c.Device(status.Device)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return types.TunnelStatus{Device: status.Device, ServerName: status.ServerName, KillSwitch: status.KillSwitch, State: types.StateDown}, nil
+	}
+	if err != nil {
+		return status, newError(types.ErrInternal, "error reading device", err)
+	}
+
+	status.Connected = true
+	if len(device.Peers) > 0 {
+		peer := device.Peers[0]
+		if peer.Endpoint != nil {
+			status.Endpoint = peer.Endpoint.String()
+		}
+		status.LastHandshake = peer.LastHandshakeTime
+		status.ReceiveBytes = peer.ReceiveBytes
+		status.TransmitBytes = peer.TransmitBytes
+	}
+	return status, nil
+}
+
+// withWireguard runs fn with a wireguard client that sees the tunnel's
+// device. A namespaced tunnel's device is only visible from its namespace.
+func withWireguard(state *tunnelState, fn func(c *wgctrl.Client) error) error {
+	run := func() error {
+		c, err := wgctrl.New()
+		if err != nil {
+			return newError(types.ErrInternal, "error getting new wireguard client", err)
+		}
+		defer c.Close()
+		return fn(c)
+	}
+	if len(state.Namespace) > 0 {
+		return inNamespace(state.Namespace, run)
+	}
+	return run()
+}
@@ -0,0 +1,192 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/whiteboxvpn/cli/types"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// How long a switch waits for the first handshake with the new server
+// before it gives up and stays on the old one, and how often it looks.
+const SWITCH_HANDSHAKE_TIMEOUT = 10 * time.Second
+const SWITCH_POLL_INTERVAL = 100 * time.Millisecond
+
+// SwitchTunnel moves traffic from a tunnel to a new one, make before break:
+// the new tunnel comes up next to the old one and has to complete a
+// handshake with its server before it gets its rules. Tearing the old
+// tunnel down then hands over whatever traffic still goes through it. At any
+// moment one of the two tunnels carries the traffic, and a kill switch lets
+// both through.
+func (l *Listener) SwitchTunnel(data types.SwitchData, reply *types.SwitchReply) error {
+	tunnelLock.Lock()
+	defer tunnelLock.Unlock()
+
+	old := findTunnel(data.Name)
+	if old == nil {
+		return logError("SwitchTunnel", newError(types.ErrNotConnected, fmt.Sprintf("no tunnel named %s is up", data.Name), nil))
+	}
+	configData := data.Config
+	if len(old.Namespace) > 0 || configData.Namespace || len(old.TunnelDomains) > 0 || len(configData.TunnelDomains) > 0 {
+		return logError("SwitchTunnel", newError(types.ErrInvalidConfig, "namespaced tunnels and tunnels of domains cannot be switched, disconnect first", nil))
+	}
+	err := checkExclusive(configData, old)
+	if err != nil {
+		return logError("SwitchTunnel", err)
+	}
+	oldPublicKey, err := devicePublicKey(old.Device)
+	if err != nil {
+		return logError("SwitchTunnel", err)
+	}
+
+	// The new tunnel's endpoint rules keep its packets to its server out of
+	// the old tunnel, which may be the very thing that stopped working
+	state := &tunnelState{}
+	err = setupTunnel(configData, state)
+	if err == nil {
+		err = awaitHandshake(state.Device)
+	}
+	if err == nil {
+		err = activateTunnel(configData, state)
+	}
+	if err != nil {
+		rollbackErr := state.Undo.rollback()
+		if rollbackErr != nil {
+			log.Print("error rolling back tunnel setup: ", rollbackErr)
+		}
+		emitEvent(types.EventError, old.Device, configData.ServerName, types.ParseRPCError(err).Message)
+		return logError("SwitchTunnel", err)
+	}
+	tunnels[state.Device] = state
+	state.setConnState(types.StateUp)
+	state.Config = configData
+
+	// resolv.conf goes straight from the old servers to the new ones, and
+	// so do the application marks
+	takeOverResolvConf(old, state, configData)
+	handOverAppMarks(old, []*tunnelState{state})
+
+	err = old.Undo.rollback()
+	if err != nil {
+		log.Printf("error tearing down tunnel %s after switching to %s: %v", old.Device, state.Device, err)
+		emitEvent(types.EventError, old.Device, old.ServerName, types.ParseRPCError(err).Message)
+		saveErr := saveState(old)
+		if saveErr != nil {
+			log.Print("error saving tunnel state: ", saveErr)
+		}
+	} else {
+		dropTunnel(old)
+	}
+
+	err = saveState(state)
+	if err != nil {
+		log.Print("error saving tunnel state: ", err)
+	}
+	log.Printf("switched tunnel %s to %s on %s", old.Device, state.ServerName, state.Device)
+	*reply = types.SwitchReply{
+		Device:        state.Device,
+		OldServerName: old.ServerName,
+		OldPublicKey:  oldPublicKey,
+	}
+	return nil
+}
+
+// devicePublicKey returns the public key of a wireguard device.
+func devicePublicKey(name string) (string, error) {
+	c, err := wgctrl.New()
+	if err != nil {
+		return "", newError(types.ErrInternal, "error getting new wireguard client", err)
+	}
+	defer c.Close()
+	device, err := c.Device(name)
+	if err != nil {
+		return "", newError(types.ErrLinkNotFound, fmt.Sprintf("error reading device %s", name), err)
+	}
+	return device.PublicKey.String(), nil
+}
+
+// awaitHandshake has the device's peer send a keepalive, which starts a
+// handshake, and waits for the handshake to complete. The keepalive is
+// turned off again afterwards.
+func awaitHandshake(name string) error {
+	c, err := wgctrl.New()
+	if err != nil {
+		return newError(types.ErrInternal, "error getting new wireguard client", err)
+	}
+	defer c.Close()
+	device, err := c.Device(name)
+	if err != nil || len(device.Peers) == 0 {
+		return newError(types.ErrLinkNotFound, fmt.Sprintf("error reading device %s", name), err)
+	}
+	peer := device.Peers[0]
+
+	keepalive := func(interval time.Duration) error {
+		return c.ConfigureDevice(name, wgtypes.Config{Peers: []wgtypes.PeerConfig{{
+			PublicKey:                   peer.PublicKey,
+			UpdateOnly:                  true,
+			PersistentKeepaliveInterval: &interval,
+		}}})
+	}
+	err = keepalive(PROBE_KEEPALIVE)
+	if err != nil {
+		return newError(types.ErrInternal, "error starting handshake", err)
+	}
+	defer keepalive(peer.PersistentKeepaliveInterval)
+
+	deadline := time.Now().Add(SWITCH_HANDSHAKE_TIMEOUT)
+	for time.Now().Before(deadline) {
+		device, err = c.Device(name)
+		if err != nil {
+			return newError(types.ErrInternal, fmt.Sprintf("error reading device %s", name), err)
+		}
+		if len(device.Peers) > 0 && !device.Peers[0].LastHandshakeTime.IsZero() {
+			return nil
+		}
+		time.Sleep(SWITCH_POLL_INTERVAL)
+	}
+	msg := fmt.Sprintf("no handshake with the new server within %s", SWITCH_HANDSHAKE_TIMEOUT)
+	return newError(types.ErrNotConnected, msg, nil)
+}
+
+// takeOverResolvConf hands the resolv.conf the old tunnel rewrote to the new
+// tunnel, with the new tunnel's DNS servers. Without DNS servers for the new
+// tunnel it stays with the old one, which puts back the original.
+func takeOverResolvConf(old *tunnelState, state *tunnelState, configData types.ConfigData) {
+	if len(configData.DNSServers) == 0 {
+		return
+	}
+	for i, a := range old.Undo.Actions {
+		if a.Kind != actionDNS || a.DNS.Method != dnsMethodResolvConf {
+			continue
+		}
+		a.DNS.Device = state.Device
+		err := updateDNS(a.DNS, configData.DNSServers, configData.SearchDomains)
+		if err != nil {
+			log.Print("error updating resolv.conf: ", err)
+		}
+		old.Undo.Actions = append(old.Undo.Actions[:i], old.Undo.Actions[i+1:]...)
+		state.Undo.record(a)
+		return
+	}
+}
@@ -0,0 +1,190 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// tunnels holds the state of every tunnel that is up, by device name. A
+// tunnel is named after its device, wb0 to wbN.
+var tunnels = map[string]*tunnelState{}
+
+// MAX_TUNNELS is how many tunnels fit into the daemon's rule priority band
+// behind the reserved priorities. Each tunnel has two priorities among the
+// tunnels for some traffic and two among the tunnels for all of it.
+const MAX_TUNNELS = (RULE_PRIORITY_COUNT - RULE_PRIORITY_RESERVED) / 4
+
+// tunnelIndex returns N for the device wbN.
+func tunnelIndex(device string) int {
+	index, err := strconv.Atoi(strings.TrimPrefix(device, DEVICE_PREFIX))
+	if err != nil {
+		return -1
+	}
+	return index
+}
+
+// nextDevice returns the first device name that neither a tunnel nor any
+// other link uses. Links a previous run of the daemon left behind are gone
+// by now, so a wireguard link with the name is somebody else's as well.
+func nextDevice() (string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return "", newError(types.ErrInternal, "error listing links", err)
+	}
+	taken := map[string]bool{}
+	for _, link := range links {
+		taken[link.Attrs().Name] = true
+	}
+	for i := 0; i < MAX_TUNNELS; i++ {
+		device := fmt.Sprintf("%s%d", DEVICE_PREFIX, i)
+		if tunnels[device] == nil && !taken[device] {
+			return device, nil
+		}
+	}
+	return "", newError(types.ErrLinkExists, fmt.Sprintf("all %d tunnels are in use", MAX_TUNNELS), nil)
+}
+
+// allocateTable returns the first id in the configured range that is free
+// both as a routing table and as a firewall mark. The same id is used for
+// both. Ids of other tunnels are taken, and so are the ids the system
+// already uses in a rule, for a route or as the mark of a wireguard device,
+// which is how the daemon stays out of the way of wg-quick and other VPNs.
+func allocateTable() (int, error) {
+	used, err := idsInUse()
+	if err != nil {
+		return 0, err
+	}
+	for _, state := range tunnels {
+		used[state.Table] = true
+		used[state.FirewallMark] = true
+	}
+
+	for id := config.TableRangeStart; id <= config.TableRangeEnd; id++ {
+		if !used[id] {
+			return id, nil
+		}
+	}
+	msg := fmt.Sprintf("every routing table and firewall mark from %d to %d is in use", config.TableRangeStart, config.TableRangeEnd)
+	return 0, newError(types.ErrRuleConflict, msg, nil)
+}
+
+// idsInUse scans the system for the routing tables and firewall marks that
+// are in use.
+func idsInUse() (map[int]bool, error) {
+	used := map[int]bool{}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return nil, newError(types.ErrInternal, "error listing rules", err)
+		}
+		for _, rule := range rules {
+			used[rule.Table] = true
+			if rule.Mark > 0 {
+				used[rule.Mark] = true
+			}
+		}
+	}
+
+	filter := &netlink.Route{Table: unix.RT_TABLE_UNSPEC}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, newError(types.ErrInternal, "error listing routes", err)
+	}
+	for _, route := range routes {
+		used[route.Table] = true
+	}
+
+	c, err := wgctrl.New()
+	if err != nil {
+		return nil, newError(types.ErrInternal, "error getting new wireguard client", err)
+	}
+	defer c.Close()
+	devices, err := c.Devices()
+	if err != nil {
+		return nil, newError(types.ErrInternal, "error listing wireguard devices", err)
+	}
+	for _, device := range devices {
+		if device.FirewallMark > 0 {
+			used[device.FirewallMark] = true
+		}
+	}
+	return used, nil
+}
+
+// findTunnel looks a tunnel up by its name or the name of its server.
+func findTunnel(name string) *tunnelState {
+	if state := tunnels[name]; state != nil {
+		return state
+	}
+	for _, state := range tunnels {
+		if state.ServerName == name {
+			return state
+		}
+	}
+	return nil
+}
+
+// sortedTunnels returns the tunnels in the order of their devices.
+func sortedTunnels() []*tunnelState {
+	var states []*tunnelState
+	for _, state := range tunnels {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return tunnelIndex(states[i].Device) < tunnelIndex(states[j].Device)
+	})
+	return states
+}
+
+// tunnelWith returns the tunnel, other than the one on device, that has an
+// action of the given kind, or nil. Some things exist only once on the
+// system, such as the DNS forwarder, and belong to one tunnel at a time.
+func tunnelWith(kind actionKind, device string) *tunnelState {
+	for _, state := range sortedTunnels() {
+		if state.Device == device {
+			continue
+		}
+		for _, a := range state.Undo.Actions {
+			if a.Kind == kind {
+				return state
+			}
+		}
+	}
+	return nil
+}
+
+// dropTunnel forgets a tunnel that was torn down.
+func dropTunnel(state *tunnelState) {
+	delete(tunnels, state.Device)
+	err := removeState(state)
+	if err != nil {
+		log.Print("error removing tunnel state: ", err)
+	}
+	emitEvent(types.EventDisconnected, state.Device, state.ServerName, "")
+}
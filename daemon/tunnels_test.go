@@ -0,0 +1,51 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestNextDevice(t *testing.T) {
+	enterTestNamespace(t, "wb0")
+	mustNetlink(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "wb3"}, PeerName: "wb2"}))
+
+	defer func() { tunnels = map[string]*tunnelState{} }()
+	tests := []struct {
+		name    string
+		tunnels []string
+		want    string
+	}{
+		{"links are taken", nil, "wb1"},
+		{"tunnels are taken", []string{"wb1"}, "wb4"},
+		{"tunnels without a link are taken", []string{"wb1", "wb4"}, "wb5"},
+	}
+	for _, test := range tests {
+		tunnels = map[string]*tunnelState{}
+		for _, device := range test.tunnels {
+			tunnels[device] = &tunnelState{Device: device}
+		}
+		got, err := nextDevice()
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %s, %v, want %s", test.name, got, err, test.want)
+		}
+	}
+}
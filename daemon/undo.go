@@ -0,0 +1,239 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/vishvananda/netlink"
+	"github.com/whiteboxvpn/cli/types"
+	"golang.org/x/sys/unix"
+)
+
+type actionKind string
+
+const (
+	actionLink    actionKind = "link"
+	actionAddress actionKind = "address"
+	actionRule    actionKind = "rule"
+	actionRoute   actionKind = "route"
+
+	actionKillSwitch actionKind = "killswitch"
+	actionDNS        actionKind = "dns"
+	actionForwarder  actionKind = "forwarder"
+	actionAppMarks   actionKind = "appmarks"
+	actionNamespace  actionKind = "namespace"
+)
+
+// An action is a single change the daemon made to the system while bringing
+// a tunnel up. Actions only hold plain data so they can be kept around after
+// the RPC call that made them returns.
+type action struct {
+	Kind    actionKind `json:"kind"`
+	Device  string     `json:"device,omitempty"`
+	Address string     `json:"address,omitempty"`
+	Rule    *ruleSpec  `json:"rule,omitempty"`
+	Route   *routeSpec `json:"route,omitempty"`
+
+	KillSwitch *killSwitchSpec `json:"killSwitch,omitempty"`
+	DNS        *dnsSpec        `json:"dns,omitempty"`
+	Forwarder  *forwarderSpec  `json:"forwarder,omitempty"`
+	AppMarks   *appMarkSpec    `json:"appMarks,omitempty"`
+	Namespace  string          `json:"namespace,omitempty"`
+}
+
+// ruleSpec describes an IP rule added by the daemon.
+type ruleSpec struct {
+	Priority          int    `json:"priority"`
+	Src               string `json:"src"`
+	Table             int    `json:"table"`
+	Mark              int    `json:"mark"`
+	Invert            bool   `json:"invert"`
+	SuppressPrefixlen int    `json:"suppressPrefixlen"`
+}
+
+// routeSpec describes an IP route added by the daemon. Routes without a
+// type go through the device; unreachable and blackhole routes have none.
+type routeSpec struct {
+	Dst    string `json:"dst"`
+	Device string `json:"device,omitempty"`
+	Table  int    `json:"table"`
+	Type   string `json:"type,omitempty"`
+}
+
+const (
+	routeTypeUnreachable = "unreachable"
+	routeTypeBlackhole   = "blackhole"
+)
+
+// undoLog records the actions taken to bring a tunnel up so that they can be
+// undone in reverse order, either because a later step failed or because the
+// user disconnected.
+type undoLog struct {
+	Actions []action `json:"actions"`
+}
+
+func (u *undoLog) record(a action) {
+	u.Actions = append(u.Actions, a)
+}
+
+// rollback undoes every recorded action, newest first. Failing actions do
+// not stop the rollback; they are kept in the log so that they can be tried
+// again, and the first error is returned once all actions have been tried.
+func (u *undoLog) rollback() error {
+	return u.rollbackExcept("")
+}
+
+// rollbackExcept is rollback, but leaves actions of the given kind in place
+// and in the log.
+func (u *undoLog) rollbackExcept(keep actionKind) error {
+	return u.rollbackWhere(func(a action) bool {
+		return a.Kind != keep
+	})
+}
+
+// rollbackWhere is rollback for only the actions that match, the others
+// stay in place and in the log.
+func (u *undoLog) rollbackWhere(match func(a action) bool) error {
+	var firstErr error
+	var remaining []action
+	for i := len(u.Actions) - 1; i >= 0; i-- {
+		a := u.Actions[i]
+		if !match(a) {
+			remaining = append([]action{a}, remaining...)
+			continue
+		}
+		err := a.undo()
+		if err != nil {
+			log.Printf("error undoing %s action: %v", a.Kind, err)
+			remaining = append([]action{a}, remaining...)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	u.Actions = remaining
+	return firstErr
+}
+
+// undo reverts a single action. Anything that is already gone counts as
+// undone.
+func (a action) undo() error {
+	var err error
+	switch a.Kind {
+	case actionLink:
+		var link netlink.Link
+		link, err = netlink.LinkByName(a.Device)
+		if err == nil {
+			err = netlink.LinkDel(link)
+		}
+	case actionAddress:
+		var link netlink.Link
+		link, err = netlink.LinkByName(a.Device)
+		if err == nil {
+			var addr *netlink.Addr
+			addr, err = netlink.ParseAddr(a.Address)
+			if err != nil {
+				return newError(types.ErrInternal, "error parsing address", err)
+			}
+			err = netlink.AddrDel(link, addr)
+		}
+	case actionRule:
+		var rule *netlink.Rule
+		rule, err = a.Rule.netlinkRule()
+		if err != nil {
+			return newError(types.ErrInternal, "error parsing rule", err)
+		}
+		err = netlink.RuleDel(rule)
+	case actionRoute:
+		var route *netlink.Route
+		route, err = a.Route.netlinkRoute()
+		if err == nil {
+			err = netlink.RouteDel(route)
+		}
+	case actionKillSwitch:
+		err = disableKillSwitch(a.KillSwitch)
+	case actionDNS:
+		err = restoreDNS(a.DNS)
+	case actionForwarder:
+		err = stopForwarder(a.Forwarder)
+	case actionAppMarks:
+		err = unmarkApps(a.AppMarks)
+	case actionNamespace:
+		err = deleteNamespace(a.Namespace, a.Device)
+	default:
+		return newError(types.ErrInternal, fmt.Sprintf("unknown action %q", a.Kind), nil)
+	}
+
+	if err != nil && !isNotExist(err) {
+		return newError(types.ErrInternal, fmt.Sprintf("error undoing %s", a.Kind), err)
+	}
+	return nil
+}
+
+// isNotExist reports whether a netlink error means the object being removed
+// does not exist.
+func isNotExist(err error) bool {
+	var linkErr netlink.LinkNotFoundError
+	return errors.As(err, &linkErr) ||
+		errors.Is(err, unix.ENOENT) ||
+		errors.Is(err, unix.ESRCH) ||
+		errors.Is(err, unix.ENODEV) ||
+		errors.Is(err, unix.EADDRNOTAVAIL)
+}
+
+func (r *ruleSpec) netlinkRule() (*netlink.Rule, error) {
+	src, err := netlink.ParseIPNet(r.Src)
+	if err != nil {
+		return nil, err
+	}
+	rule := netlink.NewRule()
+	rule.Priority = r.Priority
+	rule.Src = src
+	rule.Table = r.Table
+	rule.Mark = r.Mark
+	rule.Invert = r.Invert
+	rule.SuppressPrefixlen = r.SuppressPrefixlen
+	return rule, nil
+}
+
+func (r *routeSpec) netlinkRoute() (*netlink.Route, error) {
+	dst, err := netlink.ParseIPNet(r.Dst)
+	if err != nil {
+		return nil, newError(types.ErrInternal, "error parsing route destination", err)
+	}
+	switch r.Type {
+	case routeTypeUnreachable:
+		return &netlink.Route{Dst: dst, Table: r.Table, Type: unix.RTN_UNREACHABLE}, nil
+	case routeTypeBlackhole:
+		return &netlink.Route{Dst: dst, Table: r.Table, Type: unix.RTN_BLACKHOLE}, nil
+	}
+	link, err := netlink.LinkByName(r.Device)
+	if err != nil {
+		return nil, err
+	}
+	return &netlink.Route{
+		Dst:       dst,
+		LinkIndex: link.Attrs().Index,
+		Table:     r.Table,
+		Scope:     unix.RT_SCOPE_LINK,
+	}, nil
+}
@@ -0,0 +1,39 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+
+	"github.com/whiteboxvpn/cli/types"
+)
+
+// version is the version of wbd, set from the VERSION file when building.
+var version = "dev"
+
+// Version tells the client the daemon's version and the version of the RPC
+// API it speaks. Clients call it first on every connection and give up when
+// the API versions differ, so the call itself must never change.
+func (l *Listener) Version(data types.VersionData, reply *types.VersionReply) error {
+	if data.APIVersion != types.API_VERSION {
+		log.Printf("wb %s speaks API version %d, not %d", data.Version, data.APIVersion, types.API_VERSION)
+	}
+	*reply = types.VersionReply{Version: version, APIVersion: types.API_VERSION}
+	return nil
+}
@@ -0,0 +1,106 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+// API_VERSION is the version of the RPC API between wb and wbd. It goes up
+// whenever a change to the calls or to the types they exchange would keep
+// an older wb or wbd from understanding the other.
+const API_VERSION = 1
+
+// VersionData is what the client tells the daemon about itself when it
+// connects, VersionReply what the daemon tells the client in return.
+type VersionData struct {
+	Version    string
+	APIVersion int
+}
+
+type VersionReply struct {
+	Version    string
+	APIVersion int
+}
+
+type Reply struct {
+	Data string
+}
+
+// VPNDisconnectData names the tunnel to tear down, by its name or the name
+// of its server. Without a name every tunnel is torn down.
+type VPNDisconnectData struct {
+	Name string
+}
+
+// StatusData names the tunnel to report on, by its name or the name of its
+// server. Without a name every tunnel is reported on.
+type StatusData struct {
+	Name string
+}
+
+// AppPolicyData names the policy the calling process wants for itself and
+// the processes it starts.
+type AppPolicyData struct {
+	Policy string
+}
+
+// NamespaceExecData is the command to run in the tunnel's namespace, with
+// the environment it runs in.
+type NamespaceExecData struct {
+	Args []string
+	Env  []string
+}
+
+// NamespaceExecReply is how the command exited.
+type NamespaceExecReply struct {
+	ExitCode int
+}
+
+// NamespaceSignalData is a signal for the command started by ExecInNamespace
+// on the same connection.
+type NamespaceSignalData struct {
+	Signal int
+}
+
+// SwitchData names the tunnel to switch away from, by its name or the name
+// of its server, and describes the tunnel that takes over.
+type SwitchData struct {
+	Name   string
+	Config ConfigData
+}
+
+// SwitchReply names the tunnel that took over, and the server and public
+// key of the peer that was left, so that the client can remove that peer
+// from its server.
+type SwitchReply struct {
+	Device        string
+	OldServerName string
+	OldPublicKey  string
+}
+
+// EventsData asks for the events from the cursor on, which is the Seq of
+// the next event to see. Without a cursor the current one is returned
+// straight away, for a subscriber to start from.
+type EventsData struct {
+	Cursor uint64
+}
+
+// EventsReply holds the events from the cursor on, and the cursor to ask
+// with next.
+type EventsReply struct {
+	Events []Event
+	Cursor uint64
+}
@@ -19,9 +19,21 @@ White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
 package types
 
 type ConfigData struct {
+	ServerName          string
 	ServerPublicKeyData string
 	ClientAddress       string
+	ClientAddress6      string
 	ServerAddress       string
 	ServerPort          int
 	ClientPrivateKey    string
+	KillSwitch          bool
+	DNSServers          []string
+	SearchDomains       []string
+	IncludeRanges       []string
+	ExcludeRanges       []string
+	TunnelDomains       []string
+	AppsOnly            bool
+	Namespace           bool
+	Replace             string
+	PersistentKeepalive int
 }
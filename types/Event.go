@@ -0,0 +1,45 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "time"
+
+// Event is a change of a tunnel, as returned by the Listener.Events RPC.
+// Events are numbered in the order they happen.
+type Event struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Tunnel     string    `json:"tunnel,omitempty"`
+	ServerName string    `json:"serverName,omitempty"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// The kinds of events. A tunnel is connecting when it comes up, after it
+// roamed and after a resume, connected once it completed a handshake, and
+// handshake-stale when handshakes stopped coming. While it is reconnecting
+// every attempt is an event of its own.
+const (
+	EventConnecting     = "connecting"
+	EventConnected      = "connected"
+	EventHandshakeStale = "handshake-stale"
+	EventReconnecting   = "reconnecting"
+	EventDisconnected   = "disconnected"
+	EventError          = "error"
+)
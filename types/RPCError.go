@@ -0,0 +1,65 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrorCode identifies the kind of failure reported by the white box daemon.
+type ErrorCode string
+
+const (
+	ErrInvalidKey       ErrorCode = "invalid-key"
+	ErrInvalidConfig    ErrorCode = "invalid-config"
+	ErrLinkExists       ErrorCode = "link-exists"
+	ErrLinkNotFound     ErrorCode = "link-not-found"
+	ErrTunnelExists     ErrorCode = "tunnel-exists"
+	ErrRuleConflict     ErrorCode = "rule-conflict"
+	ErrNotConnected     ErrorCode = "not-connected"
+	ErrPermissionDenied ErrorCode = "permission-denied"
+	ErrInternal         ErrorCode = "internal"
+)
+
+// RPCError is the error returned by the daemon's RPC methods. net/rpc only
+// transports the error string, so the code is encoded in front of the
+// message and recovered on the client with ParseRPCError.
+type RPCError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("[%s] %s", e.Code, e.Message)
+}
+
+// ParseRPCError recovers the RPCError from an error returned by an RPC call.
+// Errors that did not originate from an RPCError are reported with the
+// internal error code.
+func ParseRPCError(err error) *RPCError {
+	msg := err.Error()
+	if strings.HasPrefix(msg, "[") {
+		end := strings.Index(msg, "] ")
+		if end > 0 {
+			return &RPCError{Code: ErrorCode(msg[1:end]), Message: msg[end+2:]}
+		}
+	}
+	return &RPCError{Code: ErrInternal, Message: msg}
+}
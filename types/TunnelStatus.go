@@ -0,0 +1,54 @@
+/* Copyright 2023 White Box VPN
+
+This file is part of White Box VPN CLI.
+
+White Box VPN CLI is free software: you can redistribute it and/or modify it
+under the terms of the GNU General Public License as published by the Free
+Software Foundation, either version 3 of the License, or (at your option) any
+later version.
+
+White Box VPN CLI  is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+details.
+
+You should have received a copy of the GNU General Public License along with
+White Box VPN CLI. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package types
+
+import "time"
+
+// TunnelStatus is the daemon's view of the tunnel, as returned by the
+// Listener.Status RPC.
+type TunnelStatus struct {
+	Connected      bool      `json:"connected"`
+	State          string    `json:"state,omitempty"`
+	ServerName     string    `json:"serverName,omitempty"`
+	Device         string    `json:"device,omitempty"`
+	ClientAddress  string    `json:"clientAddress,omitempty"`
+	ClientAddress6 string    `json:"clientAddress6,omitempty"`
+	IPv6Policy     string    `json:"ipv6Policy,omitempty"`
+	IncludeRanges  []string  `json:"includeRanges,omitempty"`
+	ExcludeRanges  []string  `json:"excludeRanges,omitempty"`
+	TunnelDomains  []string  `json:"tunnelDomains,omitempty"`
+	AppsOnly       bool      `json:"appsOnly"`
+	Namespace      string    `json:"namespace,omitempty"`
+	Endpoint       string    `json:"endpoint,omitempty"`
+	LastHandshake  time.Time `json:"lastHandshake,omitempty"`
+	ReceiveBytes   int64     `json:"receiveBytes"`
+	TransmitBytes  int64     `json:"transmitBytes"`
+	KillSwitch     bool      `json:"killSwitch"`
+	Keepalive      int       `json:"keepalive,omitempty"`
+}
+
+// The states of a tunnel's connection. A tunnel is connecting until the
+// first handshake with its server, and up while handshakes keep coming.
+// Once they stop it is stale, and it is down when reconnecting fails.
+const (
+	StateConnecting = "connecting"
+	StateUp         = "up"
+	StateStale      = "stale"
+	StateDown       = "down"
+)